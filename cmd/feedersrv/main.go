@@ -1,40 +1,302 @@
 package main
 
 import (
+	"github.com/bernardosecades/feeder/pkg/journal"
 	"github.com/bernardosecades/feeder/pkg/logger"
 	"github.com/bernardosecades/feeder/pkg/repository"
 	"github.com/bernardosecades/feeder/pkg/server"
 	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/sink"
 	"github.com/bernardosecades/feeder/pkg/tools/env"
+	"github.com/bernardosecades/feeder/pkg/value"
 
 	"context"
+	"errors"
 	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func main()  {
+func main() {
+	flushInterval, err := time.ParseDuration(env.GetEnvOrFallback("FLUSH_INTERVAL", "0s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	idleTimeout, err := time.ParseDuration(env.GetEnvOrFallback("IDLE_TIMEOUT", "0s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	readTimeout, err := time.ParseDuration(env.GetEnvOrFallback("READ_TIMEOUT", "0s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxSessionDuration, err := time.ParseDuration(env.GetEnvOrFallback("MAX_SESSION_DURATION", "0s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	drainTimeout, err := time.ParseDuration(env.GetEnvOrFallback("DRAIN_TIMEOUT", "5s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	snapshotInterval, err := time.ParseDuration(env.GetEnvOrFallback("SNAPSHOT_INTERVAL", "30s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxLineLength, err := strconv.Atoi(env.GetEnvOrFallback("MAX_LINE_LENGTH", "0"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxConnBytes, err := strconv.ParseInt(env.GetEnvOrFallback("MAX_CONN_BYTES", "0"), 10, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	providers, err := parseProviders(env.GetEnvOrFallback("PROVIDERS", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxProviders, err := strconv.Atoi(env.GetEnvOrFallback("MAX_PROVIDERS", "0"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cf := server.Config{
-		Protocol:  "tcp",
-		Host:      "",
-		Port:      env.GetEnvOrFallback("SVC_PORT", "4000"),
-		KeepAlive: time.Second * 60,
-		MaxConn:   5,
+		Protocol:      "tcp",
+		Host:          "",
+		Port:          env.GetEnvOrFallback("SVC_PORT", "4000"),
+		KeepAlive:     time.Second * 60,
+		MaxConn:       5,
+		FlushInterval: flushInterval,
+		MetricsAddr:   env.GetEnvOrFallback("METRICS_ADDR", ""),
+		ReportFormat:  env.GetEnvOrFallback("REPORT_FORMAT", "text"),
+		ReportPath:    env.GetEnvOrFallback("REPORT_PATH", ""),
+		Providers:     providers,
+		MaxProviders:  maxProviders,
+
+		IdleTimeout:        idleTimeout,
+		ReadTimeout:        readTimeout,
+		MaxSessionDuration: maxSessionDuration,
+		DrainTimeout:       drainTimeout,
+		MaxLineLength:      maxLineLength,
+		MaxConnBytes:       maxConnBytes,
+
+		AuthTokensFile: env.GetEnvOrFallback("AUTH_TOKENS_FILE", ""),
+		AdminAddr:      env.GetEnvOrFallback("ADMIN_ADDR", ""),
+		AdminToken:     env.GetEnvOrFallback("ADMIN_TOKEN", ""),
+		HTTPAddr:       env.GetEnvOrFallback("HTTP_ADDR", ""),
+		Handoff:        env.GetEnvOrFallback("HANDOFF", "false") == "true",
+
+		SnapshotPath:     env.GetEnvOrFallback("SNAPSHOT_PATH", ""),
+		SnapshotInterval: snapshotInterval,
+	}
+
+	if certFile := env.GetEnvOrFallback("TLS_CERT", ""); certFile != "" {
+		cf.TLS = &server.TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      env.GetEnvOrFallback("TLS_KEY", ""),
+			ClientCAFile: env.GetEnvOrFallback("TLS_CLIENT_CA", ""),
+			MinVersion:   env.GetEnvOrFallback("TLS_MIN_VERSION", "1.2"),
+		}
+	}
+
+	// local batch jobs can feed through a unix socket while remote providers use tcp
+	if socket := env.GetEnvOrFallback("UNIX_SOCKET", ""); socket != "" {
+		mode, err := strconv.ParseUint(env.GetEnvOrFallback("UNIX_SOCKET_MODE", "0660"), 8, 32)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cf.Listeners = []server.Listener{
+			{Network: cf.Protocol, Address: net.JoinHostPort(cf.Host, cf.Port)},
+			{Network: "unix", Address: socket, Mode: os.FileMode(mode)},
+		}
+	}
+
+	cf.ConnRateLimit, err = rateLimit("CONN_RATE_LIMIT", "CONN_RATE_BURST")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cf.ProviderRateLimit, err = rateLimit("PROVIDER_RATE_LIMIT", "PROVIDER_RATE_BURST")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cf.ThrottlePolicy = env.GetEnvOrFallback("THROTTLE_POLICY", server.ThrottleBackpressure)
+
+	cf.Terminate = &server.TerminatePolicy{
+		Disabled:  env.GetEnvOrFallback("TERMINATE_DISABLED", "false") == "true",
+		Secret:    env.GetEnvOrFallback("TERMINATE_SECRET", ""),
+		AuditPath: env.GetEnvOrFallback("TERMINATE_AUDIT_PATH", ""),
+	}
+	if allow := env.GetEnvOrFallback("TERMINATE_ALLOW", ""); allow != "" {
+		cf.Terminate.Allow = strings.Split(allow, ",")
 	}
 
 	l := logger.NewFileLogger("feeder_" + time.Now().Format(time.RFC3339Nano) + ".log")
 
-	skuRepository := repository.NewSkuPostgreSQL(
-		env.GetEnvOrFallback("DB_HOST", "localhost"),
-		env.GetEnvOrFallback("DB_PORT", "5416"),
-		env.GetEnvOrFallback("DB_USER", "feeder"),
-		env.GetEnvOrFallback("DB_PASS", "feeder"),
-		env.GetEnvOrFallback("DB_NAME", "feeder"),
-	)
+	batchSize, err := strconv.Atoi(env.GetEnvOrFallback("DB_BATCH_SIZE", strconv.Itoa(repository.DefaultBatchSize)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repositoryOpts := []repository.Option{repository.WithBatchSize(batchSize)}
+	if env.GetEnvOrFallback("DB_COPY", "false") == "true" {
+		repositoryOpts = append(repositoryOpts, repository.WithCopy())
+	}
+
+	sinkNames := strings.Split(env.GetEnvOrFallback("SINKS", sink.NameLogger+","+sink.NameRepository), ",")
+	webhookTimeout, err := time.ParseDuration(env.GetEnvOrFallback("SINK_WEBHOOK_TIMEOUT", "10s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookBatchSize, err := strconv.Atoi(env.GetEnvOrFallback("SINK_WEBHOOK_BATCH_SIZE", "1000"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sinkConfig := sink.Config{
+		Logger:           l,
+		JSONLinesPath:    env.GetEnvOrFallback("SINK_JSONL_PATH", ""),
+		CSVPath:          env.GetEnvOrFallback("SINK_CSV_PATH", ""),
+		Stdout:           os.Stdout,
+		WebhookURL:       env.GetEnvOrFallback("SINK_WEBHOOK_URL", ""),
+		WebhookTimeout:   webhookTimeout,
+		WebhookBatchSize: webhookBatchSize,
+	}
+
+	// database is only required when skus are persisted in the repository
+	if hasSink(sinkNames, sink.NameRepository) {
+		sinkConfig.Repository = repository.NewSkuPostgreSQL(
+			env.GetEnvOrFallback("DB_HOST", "localhost"),
+			env.GetEnvOrFallback("DB_PORT", "5416"),
+			env.GetEnvOrFallback("DB_USER", "feeder"),
+			env.GetEnvOrFallback("DB_PASS", "feeder"),
+			env.GetEnvOrFallback("DB_NAME", "feeder"),
+			repositoryOpts...,
+		)
+	}
+
+	sinks, err := sink.New(sinkNames, sinkConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	sku := service.NewService(skuRepository, l)
+	serviceOpts := []service.Option{service.WithSinks(sinks...)}
+
+	streamBatchSize, err := strconv.Atoi(env.GetEnvOrFallback("STREAM_BATCH_SIZE", "0"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if streamBatchSize > 0 {
+		streamInterval, err := time.ParseDuration(env.GetEnvOrFallback("STREAM_INTERVAL", "1s"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		streamBuffer, err := strconv.Atoi(env.GetEnvOrFallback("STREAM_BUFFER", "10000"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		serviceOpts = append(serviceOpts, service.WithStreaming(service.StreamConfig{
+			BatchSize: streamBatchSize,
+			Interval:  streamInterval,
+			Buffer:    streamBuffer,
+		}))
+	}
+	if skuFormat := env.GetEnvOrFallback("SKU_FORMAT", ""); skuFormat != "" {
+		f, err := value.ParseFormat(skuFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		serviceOpts = append(serviceOpts, service.WithFormat(f))
+	}
+
+	if journalDir := env.GetEnvOrFallback("JOURNAL_DIR", ""); journalDir != "" {
+		syncPolicy, err := journal.ParseSyncPolicy(env.GetEnvOrFallback("JOURNAL_SYNC", "always"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		syncInterval, err := time.ParseDuration(env.GetEnvOrFallback("JOURNAL_SYNC_INTERVAL", "1s"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		j, err := journal.Open(journal.Config{Dir: journalDir, Sync: syncPolicy, SyncInterval: syncInterval})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer j.Close()
+
+		serviceOpts = append(serviceOpts, service.WithJournal(j))
+	}
+
+	// skus in the journal not persisted by a previous execution are recovered here, before accepting connections
+	sku := service.NewService(sinkConfig.Repository, l, serviceOpts...)
 
 	srv := server.NewServer(cf, sku)
+	// after a handoff the new process owns the run, so this one exits without persisting
 	if err := srv.Start(context.Background()); err != nil {
 		log.Println(err)
 	}
+
+	// skus streamed in background are written before exiting
+	if err := sku.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// rateLimit it will return the rate limit (lines per second and burst) configured in env (nil when rate is not set)
+func rateLimit(rateKey, burstKey string) (*server.RateLimit, error) {
+	rate := env.GetEnvOrFallback(rateKey, "")
+	if rate == "" {
+		return nil, nil
+	}
+
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil {
+		return nil, err
+	}
+	burst, err := strconv.Atoi(env.GetEnvOrFallback(burstKey, "1"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &server.RateLimit{Rate: r, Burst: burst}, nil
+}
+
+// parseProviders it will return providers of the env, e.g.: 10.0.0.0/8=acme,192.168.1.5=other (nil when it is empty)
+func parseProviders(v string) (map[string]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	providers := map[string]string{}
+	for _, item := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("invalid provider, should be <ip or cidr>=<name>: " + item)
+		}
+		providers[parts[0]] = parts[1]
+	}
+
+	return providers, nil
+}
+
+// hasSink it will return true when the sink is in the list of names
+func hasSink(names []string, name string) bool {
+	for _, n := range names {
+		if strings.TrimSpace(n) == name {
+			return true
+		}
+	}
+
+	return false
 }
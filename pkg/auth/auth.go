@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Permission action that a token allows
+type Permission string
+
+const (
+	PermSendSkus  Permission = "may-send-skus"
+	PermTerminate Permission = "may-terminate"
+)
+
+// All errors reported by the package
+var (
+	ErrTokensFormat = errors.New("wrong tokens format, each line should be '<token> <provider> <permission>[,<permission>]'")
+)
+
+// Identity provider of a token and what it is allowed to do
+type Identity struct {
+	Provider    string
+	Permissions []Permission
+}
+
+// Can check if identity has the permission
+func (i Identity) Can(p Permission) bool {
+	for _, v := range i.Permissions {
+		if v == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+type token struct {
+	secret   []byte
+	identity Identity
+}
+
+// Tokens shared secrets of providers
+type Tokens struct {
+	tokens []token
+}
+
+// LoadTokens read tokens from a file with one token per line: '<token> <provider> <permission>[,<permission>]'.
+// Empty lines and lines starting with # are ignored.
+func LoadTokens(path string) (*Tokens, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	t := &Tokens{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: line %d", ErrTokensFormat, n)
+		}
+
+		identity := Identity{Provider: fields[1]}
+		for _, p := range strings.Split(fields[2], ",") {
+			perm := Permission(p)
+			if perm != PermSendSkus && perm != PermTerminate {
+				return nil, fmt.Errorf("%w: unknown permission %q in line %d", ErrTokensFormat, p, n)
+			}
+			identity.Permissions = append(identity.Permissions, perm)
+		}
+
+		t.tokens = append(t.tokens, token{secret: []byte(fields[0]), identity: identity})
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Authenticate return identity of the token, comparing secrets in constant time
+func (t *Tokens) Authenticate(secret string) (Identity, bool) {
+	var identity Identity
+	found := false
+	for _, tk := range t.tokens {
+		if subtle.ConstantTimeCompare(tk.secret, []byte(secret)) == 1 {
+			identity = tk.identity
+			found = true
+		}
+	}
+
+	return identity, found
+}
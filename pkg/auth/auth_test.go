@@ -0,0 +1,52 @@
+package auth_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/auth"
+
+	"github.com/stretchr/testify/assert"
+
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTokensAndAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	content := `# token provider permissions
+s3cr3t acme may-send-skus
+adm1n ops may-send-skus,may-terminate
+`
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	tokens, err := auth.LoadTokens(path)
+	assert.Nil(t, err)
+
+	identity, ok := tokens.Authenticate("s3cr3t")
+	assert.True(t, ok)
+	assert.Equal(t, "acme", identity.Provider)
+	assert.True(t, identity.Can(auth.PermSendSkus))
+	assert.False(t, identity.Can(auth.PermTerminate))
+
+	identity, ok = tokens.Authenticate("adm1n")
+	assert.True(t, ok)
+	assert.True(t, identity.Can(auth.PermTerminate))
+
+	_, ok = tokens.Authenticate("wrong")
+	assert.False(t, ok)
+}
+
+func TestLoadTokensWrongFormat(t *testing.T) {
+	cases := []string{
+		"s3cr3t acme\n",
+		"s3cr3t acme may-fly\n",
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "tokens")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(c), 0600))
+
+		_, err := auth.LoadTokens(path)
+		assert.True(t, errors.Is(err, auth.ErrTokensFormat), c)
+	}
+}
@@ -0,0 +1,292 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentPrefix = "segment-"
+const segmentExt = ".journal"
+
+// All errors reported by the package
+var (
+	ErrSealed            = errors.New("journal segment is sealed, append to the next one")
+	ErrUnknownSyncPolicy = errors.New("unknown journal sync policy, should be 'always', 'interval' or 'never'")
+)
+
+// Op kind of event written in the journal
+type Op string
+
+const (
+	OpAccepted   Op = "A"
+	OpDuplicated Op = "D"
+	OpInvalid    Op = "I"
+)
+
+// Entry one sku received by the feeder, who sent it and what happened with it. Invalid entries keep the raw line
+// received and the code of the validation error as reason.
+type Entry struct {
+	Op       Op     `json:"op"`
+	Sku      string `json:"sku,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// SyncPolicy control when the journal is flushed to disk with fsync
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // fsync after each entry
+	SyncInterval                   // fsync at most once every SyncInterval
+	SyncNever                      // the OS decides (entries survive a crash of the process but not of the machine)
+)
+
+// ParseSyncPolicy return sync policy from its name: always, interval or never
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+
+	return 0, ErrUnknownSyncPolicy
+}
+
+// Config pending text
+type Config struct {
+	Dir          string
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+type Journal interface {
+	Append(e Entry) error
+	Replay(fn func(e Entry)) error
+	Next() (Journal, error)
+	Truncate() error
+	Close() error
+}
+
+// sequence shared by all segments in the same directory
+type sequence struct {
+	mx   sync.Mutex
+	last int
+}
+
+type fileJournal struct {
+	cf       Config
+	seq      *sequence
+	mx       sync.Mutex
+	file     *os.File
+	segments []string // segments owned by this journal, the last one is where entries are appended
+	sealed   bool
+	lastSync time.Time
+}
+
+// Open create the directory if not exist and open a new segment to append entries. Segments of previous
+// executions (not truncated) are owned by the returned journal so they are replayed and removed with Truncate.
+func Open(cf Config) (Journal, error) {
+	err := os.MkdirAll(cf.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(cf.Dir, segmentPrefix+"*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	seq := &sequence{}
+	for _, m := range matches {
+		var n int
+		_, err = fmt.Sscanf(strings.TrimPrefix(filepath.Base(m), segmentPrefix), "%d", &n)
+		if err == nil && n > seq.last {
+			seq.last = n
+		}
+	}
+
+	j, err := newSegment(cf, seq)
+	if err != nil {
+		return nil, err
+	}
+	j.segments = append(matches, j.segments...)
+
+	return j, nil
+}
+
+// newSegment create journal with a new empty segment
+func newSegment(cf Config, seq *sequence) (*fileJournal, error) {
+	seq.mx.Lock()
+	seq.last++
+	name := filepath.Join(cf.Dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq.last, segmentExt))
+	seq.mx.Unlock()
+
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileJournal{
+		cf:       cf,
+		seq:      seq,
+		file:     file,
+		segments: []string{name},
+		lastSync: time.Now(),
+	}, nil
+}
+
+// Append write entry at the end of current segment and fsync it depending on sync policy
+func (j *fileJournal) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if j.sealed {
+		return ErrSealed
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	if j.cf.Sync == SyncAlways || (j.cf.Sync == SyncInterval && time.Since(j.lastSync) >= j.cf.SyncInterval) {
+		j.lastSync = time.Now()
+		return j.file.Sync()
+	}
+
+	return nil
+}
+
+// Replay read all entries of segments owned by the journal in the same order they were appended. A last line
+// partially written (process killed while writing) is ignored.
+func (j *fileJournal) Replay(fn func(e Entry)) error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	for _, name := range j.segments {
+		err := replaySegment(name, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaySegment read all entries of a segment file
+func replaySegment(name string, fn func(e Entry)) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := bufio.NewReader(file)
+	for {
+		line, err := buf.ReadBytes('\n')
+		if err == io.EOF {
+			return nil // last line without newline was not written completely
+		}
+		if err != nil {
+			return err
+		}
+
+		var e Entry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return fmt.Errorf("journal %s corrupted: %w", name, err)
+		}
+
+		fn(e)
+	}
+}
+
+// Next seal the journal (no more entries can be appended) and return a new journal with an empty segment
+func (j *fileJournal) Next() (Journal, error) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if !j.sealed {
+		err := j.seal()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	next, err := newSegment(j.cf, j.seq)
+	if err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// Truncate remove entries of the journal once they are persisted: segments are removed when the journal is
+// sealed, if not current segment is emptied to keep appending.
+func (j *fileJournal) Truncate() error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	remove := j.segments
+	if !j.sealed {
+		remove = j.segments[:len(j.segments)-1]
+
+		err := j.file.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range remove {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	j.segments = j.segments[len(remove):]
+
+	return nil
+}
+
+// Close seal the journal, entries are kept on disk to be replayed in next execution
+func (j *fileJournal) Close() error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if j.sealed {
+		return nil
+	}
+
+	return j.seal()
+}
+
+// seal fsync and close current segment
+func (j *fileJournal) seal() error {
+	j.sealed = true
+
+	err := j.file.Sync()
+	if err != nil {
+		_ = j.file.Close()
+		return err
+	}
+
+	return j.file.Close()
+}
@@ -0,0 +1,117 @@
+package journal_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/journal"
+
+	"github.com/stretchr/testify/assert"
+
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplayEntriesOfPreviousExecution(t *testing.T) {
+	cf := journal.Config{Dir: t.TempDir(), Sync: journal.SyncAlways}
+
+	j, err := journal.Open(cf)
+	assert.Nil(t, err)
+	assert.Nil(t, j.Append(journal.Entry{Op: journal.OpAccepted, Sku: "KASL-3423"}))
+	assert.Nil(t, j.Append(journal.Entry{Op: journal.OpDuplicated, Sku: "KASL-3423"}))
+	assert.Nil(t, j.Append(journal.Entry{Op: journal.OpInvalid}))
+	assert.Nil(t, j.Close())
+
+	// next execution replay entries in the same order
+	j, err = journal.Open(cf)
+	assert.Nil(t, err)
+
+	entries := []journal.Entry{}
+	err = j.Replay(func(e journal.Entry) {
+		entries = append(entries, e)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []journal.Entry{
+		{Op: journal.OpAccepted, Sku: "KASL-3423"},
+		{Op: journal.OpDuplicated, Sku: "KASL-3423"},
+		{Op: journal.OpInvalid},
+	}, entries)
+}
+
+func TestJournalIgnoreLastLineNotWrittenCompletely(t *testing.T) {
+	cf := journal.Config{Dir: t.TempDir(), Sync: journal.SyncNever}
+
+	j, err := journal.Open(cf)
+	assert.Nil(t, err)
+	assert.Nil(t, j.Append(journal.Entry{Op: journal.OpAccepted, Sku: "KASL-3423"}))
+	assert.Nil(t, j.Close())
+
+	// simulate process killed in the middle of a write
+	segments, _ := filepath.Glob(filepath.Join(cf.Dir, "*.journal"))
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte(`{"op":"A","sku":"KAS`))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	j, err = journal.Open(cf)
+	assert.Nil(t, err)
+
+	total := 0
+	err = j.Replay(func(e journal.Entry) {
+		total++
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+}
+
+func TestJournalTruncate(t *testing.T) {
+	cf := journal.Config{Dir: t.TempDir(), Sync: journal.SyncNever}
+
+	j, err := journal.Open(cf)
+	assert.Nil(t, err)
+	assert.Nil(t, j.Append(journal.Entry{Op: journal.OpAccepted, Sku: "KASL-3423"}))
+
+	// truncate an open journal keep the segment to append new entries
+	assert.Nil(t, j.Truncate())
+	assert.Nil(t, j.Append(journal.Entry{Op: journal.OpAccepted, Sku: "KASL-7770"}))
+
+	entries := []journal.Entry{}
+	err = j.Replay(func(e journal.Entry) {
+		entries = append(entries, e)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []journal.Entry{{Op: journal.OpAccepted, Sku: "KASL-7770"}}, entries)
+}
+
+func TestJournalNextSealSegment(t *testing.T) {
+	cf := journal.Config{Dir: t.TempDir(), Sync: journal.SyncNever}
+
+	j, err := journal.Open(cf)
+	assert.Nil(t, err)
+	assert.Nil(t, j.Append(journal.Entry{Op: journal.OpAccepted, Sku: "KASL-3423"}))
+
+	next, err := j.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, journal.ErrSealed, j.Append(journal.Entry{Op: journal.OpInvalid}))
+	assert.Nil(t, next.Append(journal.Entry{Op: journal.OpAccepted, Sku: "KASL-7770"}))
+
+	// truncate a sealed journal remove its segment without touching the next one
+	assert.Nil(t, j.Truncate())
+	segments, _ := filepath.Glob(filepath.Join(cf.Dir, "*.journal"))
+	assert.Len(t, segments, 1)
+
+	entries := []journal.Entry{}
+	err = next.Replay(func(e journal.Entry) {
+		entries = append(entries, e)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []journal.Entry{{Op: journal.OpAccepted, Sku: "KASL-7770"}}, entries)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	p, err := journal.ParseSyncPolicy("interval")
+	assert.Nil(t, err)
+	assert.Equal(t, journal.SyncInterval, p)
+
+	_, err = journal.ParseSyncPolicy("sometimes")
+	assert.Equal(t, journal.ErrUnknownSyncPolicy, err)
+}
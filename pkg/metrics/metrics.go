@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets upper bounds in seconds of histogram buckets, suitable for latencies from 1ms to 10s
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// metric anything that can be written in prometheus text format
+type metric interface {
+	write(w io.Writer, name string) error
+}
+
+type entry struct {
+	name   string
+	help   string
+	kind   string
+	metric metric
+}
+
+// Registry collection of metrics exposed in prometheus text format. It is safe to be used concurrently.
+type Registry struct {
+	mx      sync.Mutex
+	entries []entry
+}
+
+// NewRegistry create new instance of empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter register a counter: a value that only increase
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// NewGaugeFunc register a gauge which value is returned by fn each time metrics are collected
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, help, "gauge", gaugeFunc(fn))
+}
+
+// NewHistogram register a histogram with buckets (upper bounds sorted ascending)
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+func (r *Registry) register(name, help, kind string, m metric) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.entries = append(r.entries, entry{name: name, help: help, kind: kind, metric: m})
+}
+
+// WriteText write all metrics in prometheus text format sorted by name
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mx.Lock()
+	entries := make([]entry, len(r.entries))
+	copy(entries, r.entries)
+	r.mx.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	for _, e := range entries {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", e.name, e.help, e.name, e.kind)
+		if err != nil {
+			return err
+		}
+
+		err = e.metric.write(w, e.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler http handler to be scraped by prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = r.WriteText(w)
+	})
+}
+
+// Counter value that only increase
+type Counter struct {
+	v uint64
+}
+
+// Inc increment counter by one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increment counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value return current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	return err
+}
+
+type gaugeFunc func() float64
+
+func (g gaugeFunc) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %s\n", name, formatFloat(g()))
+	return err
+}
+
+// Histogram count observations in buckets
+type Histogram struct {
+	mx      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe add a value (e.g.: duration in seconds) to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w io.Writer, name string) error {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for i, b := range h.buckets {
+		_, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), h.counts[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n",
+		name, h.count, name, formatFloat(h.sum), name, h.count)
+	return err
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,62 @@
+package metrics_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/metrics"
+
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	c := r.NewCounter("test_lines_total", "Lines received.")
+	c.Inc()
+	c.Add(2)
+
+	r.NewGaugeFunc("test_connections", "Clients connected.", func() float64 {
+		return 4
+	})
+
+	h := r.NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	err := r.WriteText(&buf)
+	assert.Nil(t, err)
+
+	expected := `# HELP test_connections Clients connected.
+# TYPE test_connections gauge
+test_connections 4
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 2.55
+test_duration_seconds_count 3
+# HELP test_lines_total Lines received.
+# TYPE test_lines_total counter
+test_lines_total 3
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounter("test_lines_total", "Lines received.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := ioutil.ReadAll(rec.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "test_lines_total 1\n")
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket token bucket: it is filled with rate tokens per second up to burst and each event takes one token. It
+// starts full. It is safe to be used concurrently.
+type Bucket struct {
+	mx     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket create new instance of Bucket allowing rate events per second with bursts of burst events
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow take a token if there is one available, if not the event should be refused
+func (b *Bucket) Allow() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Reserve take a token even if it is not available yet and return the time to wait until it is (zero when it was
+// available)
+func (b *Bucket) Reserve() time.Duration {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.refill()
+	b.tokens--
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refill add tokens for the time since last refill
+func (b *Bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
@@ -0,0 +1,36 @@
+package ratelimit_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+
+	"testing"
+	"time"
+)
+
+func TestBucketAllow(t *testing.T) {
+	b := ratelimit.NewBucket(20, 2)
+
+	// burst
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// one token each 50ms
+	time.Sleep(time.Millisecond * 60)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+}
+
+func TestBucketReserve(t *testing.T) {
+	b := ratelimit.NewBucket(10, 1)
+
+	assert.Equal(t, time.Duration(0), b.Reserve())
+
+	// tokens are taken in advance, so each reserve waits one more token
+	wait := b.Reserve()
+	assert.True(t, wait > time.Millisecond*80 && wait <= time.Millisecond*100, wait)
+	wait = b.Reserve()
+	assert.True(t, wait > time.Millisecond*180 && wait <= time.Millisecond*200, wait)
+}
@@ -0,0 +1,263 @@
+package report
+
+import (
+	"github.com/bernardosecades/feeder/pkg/service"
+
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats supported by the writer
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// All errors reported by the package
+var (
+	ErrUnknownFormat = errors.New("unknown report format, should be 'text', 'json' or 'csv'")
+)
+
+type Writer interface {
+	Write(r service.Report) error
+	Close() error
+}
+
+// NewWriter create new instance of Writer in one of the formats: text (human readable), json (one object per
+// line) or csv (header and one row per report)
+func NewWriter(format string, out io.Writer) (Writer, error) {
+	return newWriter(format, out, nopCloser{}, true)
+}
+
+// Open create new instance of Writer appending reports to a file (stdout when path is empty). Header of csv
+// format is only written when the file is empty.
+func Open(format, path string) (Writer, error) {
+	if path == "" {
+		return NewWriter(format, os.Stdout)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	w, err := newWriter(format, file, file, info.Size() == 0)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func newWriter(format string, out io.Writer, closer io.Closer, header bool) (Writer, error) {
+	switch format {
+	case FormatText, "":
+		return &textWriter{out: out, Closer: closer}, nil
+	case FormatJSON:
+		return &jsonWriter{enc: json.NewEncoder(out), Closer: closer}, nil
+	case FormatCSV:
+		return &csvWriter{out: csv.NewWriter(out), header: header, Closer: closer}, nil
+	}
+
+	return nil, ErrUnknownFormat
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type textWriter struct {
+	out io.Writer
+	io.Closer
+}
+
+// Write print report as text, e.g: Received 50 unique product skus, 2 duplicates, 4 discard values
+func (w *textWriter) Write(r service.Report) error {
+	_, err := fmt.Fprintf(w.out, "Run %s from %s to %s (%s)\n", r.RunID,
+		r.StartedAt.Format(time.RFC3339), r.EndedAt.Format(time.RFC3339), r.ShutdownReason)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w.out, "Received %d unique product skus, %d duplicates, %d discard values\n",
+		r.Unique, r.Duplicated, r.Invalid)
+	if err != nil {
+		return err
+	}
+
+	for _, reason := range r.InvalidReasons {
+		_, err = fmt.Fprintf(w.out, "  %d discard values by %s, e.g.: %s\n", reason.Count, reason.Code,
+			quoteAll(reason.Samples))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range r.Providers {
+		_, err = fmt.Fprintf(w.out, "  provider %s: %d unique product skus, %d duplicates, %d discard values\n",
+			p.Provider, p.Unique, p.Duplicated, p.Invalid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Unauthenticated > 0 {
+		_, err = fmt.Fprintf(w.out, "Refused %d connections not authenticated\n", r.Unauthenticated)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t := r.Timeouts; t.Idle+t.Read+t.Session > 0 {
+		_, err = fmt.Fprintf(w.out, "Disconnected %d clients by timeout: %d idle, %d read, %d session\n",
+			t.Idle+t.Read+t.Session, t.Idle, t.Read, t.Session)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Throttled > 0 {
+		_, err = fmt.Fprintf(w.out, "Throttled %d lines by rate limits\n", r.Throttled)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w.out, "Persisted %d product skus, %d skipped because already persisted\n",
+		r.Inserted, r.Skipped)
+	if err != nil {
+		return err
+	}
+
+	for _, sk := range r.Sinks {
+		if sk.Error != "" {
+			_, err = fmt.Fprintf(w.out, "  sink %s failed: %s\n", sk.Sink, sk.Error)
+		} else {
+			_, err = fmt.Fprintf(w.out, "  sink %s: %d product skus written\n", sk.Sink, sk.Written)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type jsonWriter struct {
+	enc *json.Encoder
+	io.Closer
+}
+
+// Write print report as json object in one line
+func (w *jsonWriter) Write(r service.Report) error {
+	return w.enc.Encode(r)
+}
+
+type csvWriter struct {
+	out    *csv.Writer
+	header bool
+	io.Closer
+}
+
+// Write print report as row of csv, before first report it print the header
+func (w *csvWriter) Write(r service.Report) error {
+	if w.header {
+		err := w.out.Write([]string{"run_id", "started_at", "ended_at", "unique", "duplicated", "invalid",
+			"inserted", "skipped", "shutdown_reason", "invalid_reasons", "providers", "unauthenticated", "timeouts", "throttled",
+			"sinks"})
+		if err != nil {
+			return err
+		}
+		w.header = false
+	}
+
+	err := w.out.Write([]string{
+		r.RunID,
+		r.StartedAt.Format(time.RFC3339),
+		r.EndedAt.Format(time.RFC3339),
+		strconv.Itoa(int(r.Unique)),
+		strconv.Itoa(int(r.Duplicated)),
+		strconv.Itoa(int(r.Invalid)),
+		strconv.Itoa(int(r.Inserted)),
+		strconv.Itoa(int(r.Skipped)),
+		r.ShutdownReason,
+		invalidReasons(r.InvalidReasons),
+		providers(r.Providers),
+		strconv.Itoa(r.Unauthenticated),
+		timeouts(r.Timeouts),
+		strconv.Itoa(r.Throttled),
+		sinks(r.Sinks),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.out.Flush()
+	return w.out.Error()
+}
+
+// quoteAll quote and join texts with commas
+func quoteAll(texts []string) string {
+	quoted := make([]string, 0, len(texts))
+	for _, t := range texts {
+		quoted = append(quoted, strconv.Quote(t))
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// invalidReasons format invalid reasons as CODE=count separated by semicolons
+func invalidReasons(reasons []service.InvalidReason) string {
+	parts := make([]string, 0, len(reasons))
+	for _, r := range reasons {
+		parts = append(parts, r.Code+"="+strconv.Itoa(r.Count))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// providers format providers as name=unique/duplicated/invalid separated by semicolons
+func providers(providers []service.ProviderReport) string {
+	parts := make([]string, 0, len(providers))
+	for _, p := range providers {
+		parts = append(parts, fmt.Sprintf("%s=%d/%d/%d", p.Provider, p.Unique, p.Duplicated, p.Invalid))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// timeouts format timeouts as kind=count separated by semicolons
+func timeouts(t service.Timeouts) string {
+	return fmt.Sprintf("idle=%d;read=%d;session=%d", t.Idle, t.Read, t.Session)
+}
+
+// sinks format sinks as name=written, or name=error when it failed, separated by semicolons
+func sinks(sinks []service.SinkReport) string {
+	parts := make([]string, 0, len(sinks))
+	for _, sk := range sinks {
+		if sk.Error != "" {
+			parts = append(parts, sk.Sink+"=error")
+			continue
+		}
+		parts = append(parts, sk.Sink+"="+strconv.FormatInt(sk.Written, 10))
+	}
+
+	return strings.Join(parts, ";")
+}
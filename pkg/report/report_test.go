@@ -0,0 +1,104 @@
+package report_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/report"
+	"github.com/bernardosecades/feeder/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var sample = service.Report{
+	RunID:          "a1b2c3",
+	StartedAt:      time.Date(2021, 10, 3, 17, 12, 9, 0, time.UTC),
+	EndedAt:        time.Date(2021, 10, 3, 17, 13, 9, 0, time.UTC),
+	Unique:         50,
+	Duplicated:     2,
+	Invalid:        4,
+	Inserted:       48,
+	Skipped:        2,
+	ShutdownReason: "timeout",
+	InvalidReasons: []service.InvalidReason{
+		{Code: "LEN_FIRST_PART", Count: 3, Samples: []string{"AAA-1234", "AAAAA-1234"}},
+		{Code: "SEPARATOR", Count: 1, Samples: []string{"AAAA1234"}},
+	},
+	Providers: []service.ProviderReport{
+		{Provider: "acme", Unique: 45, Duplicated: 2, Invalid: 0},
+		{Provider: "unknown", Unique: 5, Duplicated: 0, Invalid: 4},
+	},
+	Unauthenticated: 1,
+	Timeouts:        service.Timeouts{Idle: 2, Read: 1},
+	Throttled:       7,
+	Sinks: []service.SinkReport{
+		{Sink: "repository", Written: 48},
+		{Sink: "webhook", Error: "webhook replied with status 500"},
+	},
+}
+
+func TestTextWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := report.NewWriter(report.FormatText, &buf)
+	assert.Nil(t, err)
+
+	assert.Nil(t, w.Write(sample))
+	assert.Equal(t, `Run a1b2c3 from 2021-10-03T17:12:09Z to 2021-10-03T17:13:09Z (timeout)
+Received 50 unique product skus, 2 duplicates, 4 discard values
+  3 discard values by LEN_FIRST_PART, e.g.: "AAA-1234", "AAAAA-1234"
+  1 discard values by SEPARATOR, e.g.: "AAAA1234"
+  provider acme: 45 unique product skus, 2 duplicates, 0 discard values
+  provider unknown: 5 unique product skus, 0 duplicates, 4 discard values
+Refused 1 connections not authenticated
+Disconnected 3 clients by timeout: 2 idle, 1 read, 0 session
+Throttled 7 lines by rate limits
+Persisted 48 product skus, 2 skipped because already persisted
+  sink repository: 48 product skus written
+  sink webhook failed: webhook replied with status 500
+`, buf.String())
+}
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := report.NewWriter(report.FormatJSON, &buf)
+	assert.Nil(t, err)
+
+	assert.Nil(t, w.Write(sample))
+	assert.JSONEq(t, `{"run_id":"a1b2c3","started_at":"2021-10-03T17:12:09Z","ended_at":"2021-10-03T17:13:09Z",
+		"unique":50,"duplicated":2,"invalid":4,"inserted":48,"skipped":2,"shutdown_reason":"timeout",
+		"invalid_reasons":[{"code":"LEN_FIRST_PART","count":3,"samples":["AAA-1234","AAAAA-1234"]},
+		{"code":"SEPARATOR","count":1,"samples":["AAAA1234"]}],
+		"providers":[{"provider":"acme","unique":45,"duplicated":2,"invalid":0},
+		{"provider":"unknown","unique":5,"duplicated":0,"invalid":4}],"unauthenticated":1,
+		"timeouts":{"idle":2,"read":1,"session":0},"throttled":7,
+		"sinks":[{"sink":"repository","written":48},
+		{"sink":"webhook","written":0,"error":"webhook replied with status 500"}]}`, buf.String())
+}
+
+func TestCSVWriterAppendToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.csv")
+
+	// header is only written when file is empty
+	for i := 0; i < 2; i++ {
+		w, err := report.Open(report.FormatCSV, path)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Write(sample))
+		assert.Nil(t, w.Close())
+	}
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	row := "a1b2c3,2021-10-03T17:12:09Z,2021-10-03T17:13:09Z,50,2,4,48,2,timeout,LEN_FIRST_PART=3;SEPARATOR=1,acme=45/2/0;unknown=5/0/4,1,idle=2;read=1;session=0,7,repository=48;webhook=error\n"
+	assert.Equal(t, "run_id,started_at,ended_at,unique,duplicated,invalid,inserted,skipped,shutdown_reason,"+
+		"invalid_reasons,providers,unauthenticated,timeouts,throttled,sinks\n"+
+		row+row, string(content))
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := report.NewWriter("xml", &bytes.Buffer{})
+	assert.Equal(t, report.ErrUnknownFormat, err)
+}
@@ -4,23 +4,48 @@ import (
 	"github.com/bernardosecades/feeder/pkg/value"
 
 	"database/sql"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"fmt"
 	"strings"
 )
 
+// DefaultBatchSize number of skus sent in each statement, far below the limit of 65535 bind parameters of PostgreSQL
+const DefaultBatchSize = 5000
+
 type Sku interface {
 	Persist(block map[string]value.Sku) (int64, error)
 	Delete(block map[string]value.Sku) (int64, error)
 }
 
+// Option customize the postgreSQL implementation of repository.Sku
+type Option func(r *skuPostgreSQL)
+
+// WithBatchSize set the number of skus sent in each statement (all of them inside the same transaction)
+func WithBatchSize(size int) Option {
+	return func(r *skuPostgreSQL) {
+		if size > 0 {
+			r.batchSize = size
+		}
+	}
+}
+
+// WithCopy persist skus with COPY protocol into a temporary table and merge it in records table, it is faster
+// than batches of inserts when there are a lot of skus
+func WithCopy() Option {
+	return func(r *skuPostgreSQL) {
+		r.copy = true
+	}
+}
+
 type skuPostgreSQL struct {
-	SQL *sql.DB
+	SQL       *sql.DB
+	batchSize int
+	copy      bool
 }
 
 // NewSkuPostgreSQL create new instance of repository.Sku with postgresSQL implementation
-func NewSkuPostgreSQL(host, port, user, pass, db string) Sku {
+func NewSkuPostgreSQL(host, port, user, pass, db string, opts ...Option) Sku {
 	dbSource := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		host, port, user, pass, db)
 	d, err := sql.Open("postgres", dbSource)
@@ -33,30 +58,105 @@ func NewSkuPostgreSQL(host, port, user, pass, db string) Sku {
 		panic(err)
 	}
 
+	r := &skuPostgreSQL{SQL: d, batchSize: DefaultBatchSize}
+	for _, opt := range opts {
+		opt(r)
+	}
 
-	return &skuPostgreSQL{SQL: d}
+	return r
 }
 
 // Persist save block of value.sku in records table and will ignore the insert if sku already exist
-// It will return number of skus inserted
+// It will return number of skus inserted. All batches are persisted in the same transaction.
 func (r *skuPostgreSQL) Persist(block map[string]value.Sku) (int64, error) {
 	if len(block) == 0 {
 		return 0, nil
 	}
 
-	valueStrings := []string{}
-	valueArgs := []interface{}{}
-	i := 1
+	tx, err := r.SQL.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var inserted int64
+	if r.copy {
+		inserted, err = r.persistCopy(tx, block)
+	} else {
+		inserted, err = r.persistBatches(tx, block)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return inserted, nil
+}
+
+// persistBatches insert skus in batches of batchSize, it will return number of skus inserted in all batches
+func (r *skuPostgreSQL) persistBatches(tx *sql.Tx, block map[string]value.Sku) (int64, error) {
+	var inserted int64
+	for _, batch := range r.batches(block) {
+		valueStrings := []string{}
+		for i := range batch {
+			valueStrings = append(valueStrings, fmt.Sprintf("($%d)", i+1))
+		}
+
+		smt := `INSERT INTO records (sku) VALUES %s ON CONFLICT (sku) DO NOTHING`
+		smt = fmt.Sprintf(smt, strings.Join(valueStrings, ","))
+		result, err := tx.Exec(smt, batch...)
+		if err != nil {
+			return 0, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		inserted += rows
+	}
+
+	return inserted, nil
+}
+
+// persistCopy copy skus in a temporary table (dropped on commit) and insert them in records table ignoring
+// skus already persisted, it will return number of skus inserted
+func (r *skuPostgreSQL) persistCopy(tx *sql.Tx, block map[string]value.Sku) (int64, error) {
+	_, err := tx.Exec(`CREATE TEMP TABLE records_copy (sku varchar(50)) ON COMMIT DROP`)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("records_copy", "sku"))
+	if err != nil {
+		return 0, err
+	}
+
 	for _, w := range block {
-		element := fmt.Sprintf("($%d)", i)
-		valueStrings = append(valueStrings, element)
-		valueArgs = append(valueArgs, w.String())
-		i++
+		_, err = stmt.Exec(w.String())
+		if err != nil {
+			_ = stmt.Close()
+			return 0, err
+		}
+	}
+
+	// exec without arguments flush buffered data
+	_, err = stmt.Exec()
+	if err != nil {
+		_ = stmt.Close()
+		return 0, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return 0, err
 	}
 
-	smt := `INSERT INTO records (sku) VALUES %s ON CONFLICT (sku) DO NOTHING`
-	smt = fmt.Sprintf(smt, strings.Join(valueStrings, ","))
-	result, err := r.SQL.Exec(smt, valueArgs...)
+	result, err := tx.Exec(`INSERT INTO records (sku) SELECT sku FROM records_copy ON CONFLICT (sku) DO NOTHING`)
 	if err != nil {
 		return 0, err
 	}
@@ -64,29 +164,64 @@ func (r *skuPostgreSQL) Persist(block map[string]value.Sku) (int64, error) {
 	return result.RowsAffected()
 }
 
-// Delete remove block of value.sku in records table and it will return number of skus deleted
+// Delete remove block of value.sku in records table and it will return number of skus deleted. All batches are
+// deleted in the same transaction.
 func (r *skuPostgreSQL) Delete(block map[string]value.Sku) (int64, error) {
 	if len(block) == 0 {
 		return 0, nil
 	}
 
-	valueStrings := []string{}
-	valueArgs := []interface{}{}
-	i := 1
-	for _, w := range block {
-		element := fmt.Sprintf("$%d", i)
-		valueStrings = append(valueStrings, element)
-		valueArgs = append(valueArgs, w.String())
-		i++
+	tx, err := r.SQL.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, batch := range r.batches(block) {
+		valueStrings := []string{}
+		for i := range batch {
+			valueStrings = append(valueStrings, fmt.Sprintf("$%d", i+1))
+		}
+
+		smt := `DELETE FROM records WHERE sku IN (%s)`
+		smt = fmt.Sprintf(smt, strings.Join(valueStrings, ","))
+		result, err := tx.Exec(smt, batch...)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		deleted += rows
 	}
 
-	smt := `DELETE FROM records WHERE sku IN (%s)`
-	smt = fmt.Sprintf(smt, strings.Join(valueStrings, ","))
-	result, err := r.SQL.Exec(smt, valueArgs...)
+	err = tx.Commit()
 	if err != nil {
 		return 0, err
 	}
 
-	return result.RowsAffected()
+	return deleted, nil
 }
 
+// batches split block of skus in slices of batchSize arguments
+func (r *skuPostgreSQL) batches(block map[string]value.Sku) [][]interface{} {
+	batches := [][]interface{}{}
+	batch := make([]interface{}, 0, r.batchSize)
+	for _, w := range block {
+		batch = append(batch, w.String())
+		if len(batch) == r.batchSize {
+			batches = append(batches, batch)
+			batch = make([]interface{}, 0, r.batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
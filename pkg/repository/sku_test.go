@@ -49,3 +49,67 @@ func TestPersistAndDelete(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, 0, rowsDeleted)
 }
+
+func TestPersistAndDeleteInBatches(t *testing.T) {
+	r := repository.NewSkuPostgreSQL(
+		env.GetEnvOrFallback("DB_HOST", "localhost"),
+		env.GetEnvOrFallback("DB_PORT", "5416"),
+		env.GetEnvOrFallback("DB_USER", "feeder"),
+		env.GetEnvOrFallback("DB_PASS", "feeder"),
+		env.GetEnvOrFallback("DB_NAME", "feeder"),
+		repository.WithBatchSize(2),
+	)
+
+	data := make(map[string]value.Sku)
+	for _, v := range []string{"BTCH-0001", "BTCH-0002", "BTCH-0003", "BTCH-0004", "BTCH-0005"} {
+		sku, _ := value.NewSku(v)
+		data[sku.String()] = sku
+	}
+
+	// inserted rows are counted in all batches
+	rowsInserted, err := r.Persist(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 5, rowsInserted)
+
+	// skus already persisted are ignored
+	rowsInserted, err = r.Persist(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, rowsInserted)
+
+	rowsDeleted, err := r.Delete(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 5, rowsDeleted)
+}
+
+func TestPersistWithCopy(t *testing.T) {
+	r := repository.NewSkuPostgreSQL(
+		env.GetEnvOrFallback("DB_HOST", "localhost"),
+		env.GetEnvOrFallback("DB_PORT", "5416"),
+		env.GetEnvOrFallback("DB_USER", "feeder"),
+		env.GetEnvOrFallback("DB_PASS", "feeder"),
+		env.GetEnvOrFallback("DB_NAME", "feeder"),
+		repository.WithCopy(),
+	)
+
+	data := make(map[string]value.Sku)
+	for _, v := range []string{"COPY-0001", "COPY-0002", "COPY-0003"} {
+		sku, _ := value.NewSku(v)
+		data[sku.String()] = sku
+	}
+
+	rowsInserted, err := r.Persist(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, rowsInserted)
+
+	// add a new sku, only that one is inserted
+	sku, _ := value.NewSku("COPY-0004")
+	data[sku.String()] = sku
+
+	rowsInserted, err = r.Persist(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, rowsInserted)
+
+	rowsDeleted, err := r.Delete(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4, rowsDeleted)
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"github.com/bernardosecades/feeder/pkg/service"
+
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Commands of the admin listener, each one is replied with a json object in one line
+const (
+	adminStatus      = "STATUS"
+	adminStats       = "STATS"
+	adminConnections = "CONNECTIONS"
+	adminFlush       = "FLUSH"
+	adminShutdown    = "SHUTDOWN"
+)
+
+// unixPrefix prefix of AdminAddr to listen in a unix socket
+const unixPrefix = "unix:"
+
+// adminProvider provider of admin clients authenticated with the admin token, it can be allowed to SHUTDOWN in the
+// terminate policy
+const adminProvider = "admin"
+
+// adminSocketMode permissions of the admin unix socket, only the user running the server can connect
+const adminSocketMode = 0600
+
+// All errors reported by the admin listener
+var (
+	ErrAdminToken = errors.New("admin listener in a tcp address requires an admin token")
+)
+
+// Status reply of STATUS command
+type Status struct {
+	RunID             string    `json:"run_id"`
+	StartedAt         time.Time `json:"started_at"`
+	Uptime            float64   `json:"uptime_seconds"`
+	Mode              string    `json:"mode"`
+	ActiveConnections int       `json:"active_connections"`
+	MaxConnections    int       `json:"max_connections"`
+	Queued            int       `json:"queued"`
+}
+
+// Connection item of the reply of CONNECTIONS command
+type Connection struct {
+	Address     string    `json:"address"`
+	Provider    string    `json:"provider"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Lines       int64     `json:"lines"`
+}
+
+// authReply reply of 'AUTH <token>' when the admin token is accepted
+type authReply struct {
+	Authenticated bool `json:"authenticated"`
+}
+
+// errorReply reply of a command or request failed
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+// flushResult result of a FLUSH request handled by Start
+type flushResult struct {
+	report service.Report
+	err    error
+}
+
+// clients connections being handled
+type clients struct {
+	mx    sync.Mutex
+	items map[*client]struct{}
+}
+
+func newClients() *clients {
+	return &clients{items: map[*client]struct{}{}}
+}
+
+func (cs *clients) add(c *client) {
+	cs.mx.Lock()
+	defer cs.mx.Unlock()
+
+	cs.items[c] = struct{}{}
+}
+
+func (cs *clients) remove(c *client) {
+	cs.mx.Lock()
+	defer cs.mx.Unlock()
+
+	delete(cs.items, c)
+}
+
+// all return clients being handled
+func (cs *clients) all() []*client {
+	cs.mx.Lock()
+	defer cs.mx.Unlock()
+
+	all := make([]*client, 0, len(cs.items))
+	for c := range cs.items {
+		all = append(all, c)
+	}
+
+	return all
+}
+
+// list return connections sorted by the time they were accepted
+func (cs *clients) list() []Connection {
+	cs.mx.Lock()
+	defer cs.mx.Unlock()
+
+	list := make([]Connection, 0, len(cs.items))
+	for c := range cs.items {
+		c.mx.Lock()
+		list = append(list, Connection{
+			Address:     c.conn.RemoteAddr().String(),
+			Provider:    c.provider,
+			ConnectedAt: c.connectedAt,
+			Lines:       atomic.LoadInt64(&c.lines),
+		})
+		c.mx.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ConnectedAt.Before(list[j].ConnectedAt)
+	})
+
+	return list
+}
+
+// serveAdmin start the admin listener in addr (host:port or unix:<path>). Admin connections don't take slots of
+// MaxConn and can send several commands until they close the connection. In a tcp address clients must authenticate
+// with AdminToken, the unix socket is only accessible by the user running the server (and the token is required
+// too when it is set).
+func (s *server) serveAdmin(addr string) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, unixPrefix) {
+		network = "unix"
+		addr = strings.TrimPrefix(addr, unixPrefix)
+		err := removeStaleSocket(addr)
+		if err != nil {
+			return nil, err
+		}
+	} else if s.cf.AdminToken == "" {
+		return nil, ErrAdminToken
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		err = os.Chmod(addr, adminSocketMode)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println("admin listener closed", err)
+				return
+			}
+			go s.adminHandler(conn)
+		}
+	}()
+
+	return l, nil
+}
+
+// adminHandler it will reply each command sent by the admin client. When AdminToken is set the first line must be
+// 'AUTH <token>', otherwise the connection is closed.
+func (s *server) adminHandler(conn net.Conn) {
+	defer conn.Close()
+
+	c := &client{conn: conn, connectedAt: time.Now()}
+	authenticated := s.cf.AdminToken == ""
+
+	buf := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		input, err := buf.ReadString('\n')
+		if err != nil {
+			return
+		}
+		input = strings.TrimSpace(input)
+
+		var reply interface{}
+		if !authenticated {
+			authenticated = s.adminAuthenticate(input)
+			if !authenticated {
+				log.Println("admin client not authenticated", conn.RemoteAddr().String())
+				_ = enc.Encode(errorReply{Error: "not authenticated"})
+				return
+			}
+			// the token identify the client, so the terminate policy can allow it by provider
+			c.provider = adminProvider
+			c.identified = true
+			reply = authReply{Authenticated: true}
+		} else {
+			reply = s.adminCommand(c, input)
+		}
+
+		err = enc.Encode(reply)
+		if err != nil {
+			log.Println("admin client disconnected", err)
+			return
+		}
+	}
+}
+
+// adminAuthenticate return true when the line is 'AUTH <token>' with the admin token
+func (s *server) adminAuthenticate(input string) bool {
+	if !strings.HasPrefix(input, authCommand) {
+		return false
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(input, authCommand))
+	return subtle.ConstantTimeCompare([]byte(s.cf.AdminToken), []byte(token)) == 1
+}
+
+// adminCommand run the command (case insensitive) and return its reply. SHUTDOWN can be followed by the secret of
+// the terminate policy.
+func (s *server) adminCommand(c *client, input string) interface{} {
+	command, arg := input, ""
+	if i := strings.Index(input, " "); i >= 0 {
+		command, arg = input[:i], strings.TrimSpace(input[i+1:])
+	}
+
+	switch strings.ToUpper(command) {
+	case adminStatus:
+		return s.status()
+	case adminStats:
+		return s.feeder.Report()
+	case adminConnections:
+		return s.clients.list()
+	case adminFlush:
+		reply := make(chan flushResult, 1)
+		select {
+		case s.flushCh <- reply:
+		case <-s.drainCh:
+			return errorReply{Error: "server stopping"}
+		}
+		res := <-reply
+		if res.err != nil {
+			return errorReply{Error: res.err.Error()}
+		}
+		return res.report
+	case adminShutdown:
+		// same policy (and audit) than clients sending 'terminate'
+		reason := s.terminatePolicy.check(c, arg)
+		s.audit.write(c, reason)
+		if reason != "" {
+			return errorReply{Error: "forbidden: " + reason}
+		}
+
+		select {
+		case s.shutdownCh <- true:
+			return s.status()
+		case <-s.drainCh:
+			return errorReply{Error: "server stopping"}
+		}
+	}
+
+	return errorReply{Error: "unknown command, should be STATUS, STATS, CONNECTIONS, FLUSH or SHUTDOWN"}
+}
+
+// status return state of the server
+func (s *server) status() Status {
+	mode := "one-shot"
+	if s.cf.FlushInterval > 0 {
+		mode = "daemon"
+	} else if s.cf.Session {
+		mode = "session"
+	}
+
+	return Status{
+		RunID:             s.runID,
+		StartedAt:         s.startedAt,
+		Uptime:            time.Since(s.startedAt).Seconds(),
+		Mode:              mode,
+		ActiveConnections: len(s.connCh),
+		MaxConnections:    s.cf.MaxConn,
+		Queued:            int(atomic.LoadInt32(&s.queued)),
+	}
+}
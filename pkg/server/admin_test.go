@@ -0,0 +1,238 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+	"github.com/bernardosecades/feeder/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerAdmin(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+
+	go func() {
+		conn, err := dial("localhost:5090")
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(conn)
+		for _, line := range []string{"HELLO acme\n", "KASL-3423\n"} {
+			_, err = conn.Write([]byte(line))
+			assert.Nil(t, err)
+			_, err = buf.ReadString('\n')
+			assert.Nil(t, err)
+		}
+
+		admin, err := dialNetwork("unix", socket)
+		assert.Nil(t, err)
+		replies := bufio.NewReader(admin)
+
+		var status server.Status
+		adminCommand(t, admin, replies, "STATUS", &status)
+		assert.Equal(t, "daemon", status.Mode)
+		assert.Equal(t, 1, status.ActiveConnections)
+		assert.Equal(t, 2, status.MaxConnections)
+		assert.NotEmpty(t, status.RunID)
+
+		var connections []server.Connection
+		adminCommand(t, admin, replies, "CONNECTIONS", &connections)
+		assert.Len(t, connections, 1)
+		assert.Equal(t, "acme", connections[0].Provider)
+		assert.Equal(t, int64(2), connections[0].Lines)
+
+		var r service.Report
+		adminCommand(t, admin, replies, "FLUSH", &r)
+		assert.Equal(t, server.ReasonFlush, r.ShutdownReason)
+
+		var unknown map[string]string
+		adminCommand(t, admin, replies, "REBOOT", &unknown)
+		assert.NotEmpty(t, unknown["error"])
+
+		// only the user running the server can connect to the socket
+		info, err := os.Stat(socket)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		adminCommand(t, admin, replies, "SHUTDOWN", &status)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:      "tcp",
+		Host:          "",
+		Port:          "5090",
+		KeepAlive:     time.Second * 2,
+		MaxConn:       2,
+		Session:       true,
+		FlushInterval: time.Hour,
+		AdminAddr:     "unix:" + socket,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, server.ErrAdminShutdown, err)
+
+	// skus are persisted by FLUSH and when the server shutdown
+	assert.Equal(t, 2, mockFeeder.CallsPersist)
+	assert.Equal(t, 2, mockFeeder.CallsRotate)
+}
+
+func TestServerAdminTokenAndPolicy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	go func() {
+		var reply map[string]interface{}
+
+		// commands are refused until the client is authenticated
+		for _, command := range []string{"STATUS", "AUTH wrong"} {
+			admin, err := dial("localhost:5151")
+			assert.Nil(t, err)
+			adminCommand(t, admin, bufio.NewReader(admin), command, &reply)
+			assert.Equal(t, "not authenticated", reply["error"])
+			_ = admin.Close()
+		}
+
+		admin, err := dial("localhost:5151")
+		assert.Nil(t, err)
+		replies := bufio.NewReader(admin)
+
+		adminCommand(t, admin, replies, "AUTH t0k3n", &reply)
+		assert.Equal(t, true, reply["authenticated"])
+
+		// the session is not split in windows
+		adminCommand(t, admin, replies, "FLUSH", &reply)
+		assert.Equal(t, server.ReasonFlush, reply["shutdown_reason"])
+
+		adminCommand(t, admin, replies, "SHUTDOWN", &reply)
+		assert.Equal(t, "forbidden: disabled", reply["error"])
+		_ = admin.Close()
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:   "tcp",
+		Host:       "",
+		Port:       "5150",
+		KeepAlive:  time.Millisecond * 500,
+		MaxConn:    1,
+		Session:    true,
+		AdminAddr:  "localhost:5151",
+		AdminToken: "t0k3n",
+		Terminate:  &server.TerminatePolicy{Disabled: true, AuditPath: path},
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	// server is only stopped by KeepAlive
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 2, mockFeeder.CallsPersist)
+	assert.Equal(t, 0, mockFeeder.CallsRotate)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"provider":"admin"`)
+	assert.Contains(t, lines[0], `"reason":"disabled"`)
+}
+
+func TestServerAdminFlushSession(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+
+	go func() {
+		conn, err := dial("localhost:5190")
+		assert.Nil(t, err)
+		exchange(t, conn, []string{"KASL-3423"}, []string{"OK"})
+
+		admin, err := dial("localhost:5191")
+		assert.Nil(t, err)
+		replies := bufio.NewReader(admin)
+
+		var auth map[string]interface{}
+		adminCommand(t, admin, replies, "AUTH t0k3n", &auth)
+
+		var r service.Report
+		adminCommand(t, admin, replies, "FLUSH", &r)
+		assert.EqualValues(t, 1, r.Unique)
+		assert.EqualValues(t, 1, r.Inserted)
+
+		// skus flushed are still duplicated in the session
+		exchange(t, conn, []string{"KASL-3423", "KASL-7770"}, []string{"OK", "OK"})
+		_ = admin.Close()
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5190",
+		KeepAlive:    time.Millisecond * 500,
+		MaxConn:      1,
+		Session:      true,
+		AdminAddr:    "localhost:5191",
+		AdminToken:   "t0k3n",
+		ReportFormat: "json",
+		ReportPath:   reportPath,
+	}
+
+	srv := server.NewServer(cf, service.NewService(MockSkuRepository{}, MockLogger{}))
+
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// last report of the session count all skus, only the ones received after FLUSH are inserted
+	content, err := ioutil.ReadFile(reportPath)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 2)
+
+	var r service.Report
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &r))
+	assert.EqualValues(t, 2, r.Unique)
+	assert.EqualValues(t, 1, r.Duplicated)
+	assert.EqualValues(t, 1, r.Inserted)
+}
+
+func TestServerAdminRequiresTokenInTCP(t *testing.T) {
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5155",
+		KeepAlive: time.Millisecond * 300,
+		MaxConn:   1,
+		AdminAddr: "localhost:5156",
+	}
+
+	srv := server.NewServer(cf, &MockFeeder{})
+
+	err := srv.Start(context.Background())
+	assert.Equal(t, server.ErrAdminToken, err)
+}
+
+// adminCommand it will send the command to the admin listener and decode its reply
+func adminCommand(t *testing.T, conn net.Conn, replies *bufio.Reader, command string, reply interface{}) {
+	_, err := conn.Write([]byte(command + "\n"))
+	assert.Nil(t, err)
+
+	line, err := replies.ReadBytes('\n')
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(line, reply))
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"github.com/bernardosecades/feeder/pkg/service"
+
+	"bufio"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of deadline exceeded by a client
+const (
+	timeoutIdle    = "idle"
+	timeoutRead    = "read"
+	timeoutSession = "session"
+)
+
+// timeoutError the client exceeded a deadline
+type timeoutError struct {
+	kind string
+}
+
+func (e *timeoutError) Error() string {
+	return "client " + e.kind + " timeout"
+}
+
+// timeouts clients disconnected by each kind of deadline in current window (only modified with atomic)
+type timeouts struct {
+	idle    int64
+	read    int64
+	session int64
+}
+
+func (t *timeouts) inc(kind string) {
+	switch kind {
+	case timeoutIdle:
+		atomic.AddInt64(&t.idle, 1)
+	case timeoutRead:
+		atomic.AddInt64(&t.read, 1)
+	case timeoutSession:
+		atomic.AddInt64(&t.session, 1)
+	}
+}
+
+// swap return counters and reset them for the next window
+func (t *timeouts) swap() service.Timeouts {
+	return service.Timeouts{
+		Idle:    int(atomic.SwapInt64(&t.idle, 0)),
+		Read:    int(atomic.SwapInt64(&t.read, 0)),
+		Session: int(atomic.SwapInt64(&t.session, 0)),
+	}
+}
+
+// load return counters without resetting them
+func (t *timeouts) load() service.Timeouts {
+	return service.Timeouts{
+		Idle:    int(atomic.LoadInt64(&t.idle)),
+		Read:    int(atomic.LoadInt64(&t.read)),
+		Session: int(atomic.LoadInt64(&t.session)),
+	}
+}
+
+// readLine it will read next line of the client enforcing deadlines: IdleTimeout while waiting for the first byte of
+// the line, ReadTimeout until the newline and MaxSessionDuration for the whole connection. When one of them is
+// exceeded it returns a *timeoutError. Lines longer than MaxLineLength are returned truncated with errLineTooLong.
+func (s *server) readLine(c *client, buf *bufio.Reader) (string, error) {
+	deadlines := s.cf.IdleTimeout > 0 || s.cf.ReadTimeout > 0 || s.cf.MaxSessionDuration > 0
+
+	if deadlines {
+		err := c.conn.SetReadDeadline(s.deadline(c, s.cf.IdleTimeout))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	_, err := buf.Peek(1)
+	if err != nil {
+		return "", s.timeout(c, err, timeoutIdle)
+	}
+
+	atomic.StoreInt32(&c.inLine, 1)
+	defer atomic.StoreInt32(&c.inLine, 0)
+
+	if deadlines {
+		err = c.conn.SetReadDeadline(s.deadline(c, s.cf.ReadTimeout))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	line, err := s.readString(buf)
+	if err != nil && err != errLineTooLong {
+		return "", s.timeout(c, err, timeoutRead)
+	}
+
+	return line, err
+}
+
+// deadline return the earliest of now plus timeout and the end of the session (zero time means no deadline)
+func (s *server) deadline(c *client, timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+
+	if s.cf.MaxSessionDuration > 0 {
+		end := c.connectedAt.Add(s.cf.MaxSessionDuration)
+		if d.IsZero() || end.Before(d) {
+			d = end
+		}
+	}
+
+	return d
+}
+
+// timeout it will return a *timeoutError of the kind (session when the session is over) if err is a timeout
+func (s *server) timeout(c *client, err error, kind string) error {
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		return err
+	}
+
+	if s.cf.MaxSessionDuration > 0 && !time.Now().Before(c.connectedAt.Add(s.cf.MaxSessionDuration)) {
+		kind = timeoutSession
+	}
+
+	return &timeoutError{kind: kind}
+}
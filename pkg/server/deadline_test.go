@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+	"github.com/bernardosecades/feeder/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerDeadlines(t *testing.T) {
+	// client that never send anything
+	go func() {
+		conn, err := dial("localhost:5105")
+		assert.Nil(t, err)
+		_, err = ioutil.ReadAll(conn)
+		assert.Nil(t, err)
+	}()
+
+	// client that never finish the line
+	go func() {
+		conn, err := dial("localhost:5105")
+		assert.Nil(t, err)
+		_, err = conn.Write([]byte("KASL"))
+		assert.Nil(t, err)
+		_, err = ioutil.ReadAll(conn)
+		assert.Nil(t, err)
+	}()
+
+	// client sending lines until the session is over
+	go func() {
+		conn, err := dial("localhost:5105")
+		assert.Nil(t, err)
+		for {
+			_, err = conn.Write([]byte("KASL-3423\n"))
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 3)
+			_, err = io.ReadFull(conn, buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+	}()
+
+	// start server
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "report.json")
+	cf := server.Config{
+		Protocol:           "tcp",
+		Host:               "",
+		Port:               "5105",
+		KeepAlive:          time.Millisecond * 500,
+		MaxConn:            3,
+		Session:            true,
+		IdleTimeout:        time.Millisecond * 50,
+		ReadTimeout:        time.Millisecond * 50,
+		MaxSessionDuration: time.Millisecond * 150,
+		ReportFormat:       "json",
+		ReportPath:         path,
+	}
+
+	srv := server.NewServer(cf, &MockFeeder{})
+
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	var r service.Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.Equal(t, service.Timeouts{Idle: 1, Read: 1, Session: 1}, r.Timeouts)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownNotice line sent to connected (and queued) clients when the server starts draining connections to stop
+const shutdownNotice = "SHUTTING DOWN\n"
+
+// drainPoll interval checking if all connections finished while draining
+const drainPoll = time.Millisecond * 10
+
+// drain it will stop accepting connections, notify connected clients and wait up to DrainTimeout for lines being
+// received, then connections still open are closed. It returns when all connections finished, so skus of lines in
+// progress are included when the feeder is flushed.
+func (s *server) drain() {
+	close(s.drainCh)
+
+	for _, l := range s.openListeners {
+		_ = l.Close()
+	}
+	if s.httpServer != nil {
+		go shutdownHTTP(s.httpServer)
+	}
+	s.cancelConns()
+
+	for _, c := range s.clients.all() {
+		s.notify(c)
+	}
+
+	deadline := time.Now().Add(s.cf.DrainTimeout)
+	for len(s.connCh) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+
+	if remaining := s.clients.all(); len(remaining) > 0 {
+		log.Println("closing", len(remaining), "connections after drain timeout")
+		for _, c := range remaining {
+			_ = c.conn.Close()
+		}
+	}
+
+	// handlers are not blocked anymore, so wait for them to release their slots
+	for len(s.connCh) > 0 {
+		time.Sleep(drainPoll)
+	}
+}
+
+// notify it will send the shutdown notice to the client and make its read finish: right away when it is waiting for
+// a new line, or after DrainTimeout when it is receiving one
+func (s *server) notify(c *client) {
+	err := c.write(shutdownNotice)
+	if err != nil {
+		log.Println("error notifying shutdown", err)
+	}
+
+	deadline := time.Now()
+	if atomic.LoadInt32(&c.inLine) == 1 {
+		deadline = deadline.Add(s.cf.DrainTimeout)
+	}
+
+	err = c.conn.SetReadDeadline(deadline)
+	if err != nil {
+		log.Println("error notifying shutdown", err)
+	}
+}
+
+// draining return true once the server started draining connections to stop
+func (s *server) draining() bool {
+	select {
+	case <-s.drainCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// rejectQueued it will reject connections waiting in the queue because the server is stopping
+func (s *server) rejectQueued() {
+	for {
+		select {
+		case q := <-s.queueCh:
+			s.reject(q.conn, shutdownNotice)
+			atomic.AddInt32(&s.queued, -1)
+		default:
+			return
+		}
+	}
+}
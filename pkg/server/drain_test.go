@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestServerDrainOnShutdown(t *testing.T) {
+	idle := make(chan bool)
+	inLine := make(chan bool)
+
+	// idle client is notified and its connection closed
+	go func() {
+		conn, err := dial("localhost:5130")
+		assert.Nil(t, err)
+		buf := bufio.NewReader(conn)
+		notice, err := buf.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "SHUTTING DOWN\n", notice)
+		_, err = buf.ReadString('\n')
+		assert.Equal(t, io.EOF, err)
+		idle <- true
+	}()
+
+	// client in the middle of a line can finish it after the notice
+	go func() {
+		conn, err := dial("localhost:5130")
+		assert.Nil(t, err)
+		_, err = conn.Write([]byte("KASL-"))
+		assert.Nil(t, err)
+		buf := bufio.NewReader(conn)
+		notice, err := buf.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "SHUTTING DOWN\n", notice)
+		_, err = conn.Write([]byte("3423\n"))
+		assert.Nil(t, err)
+		reply, err := buf.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "OK\n", reply)
+		inLine <- true
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5130",
+		KeepAlive:    time.Millisecond * 300,
+		MaxConn:      2,
+		Session:      true,
+		DrainTimeout: time.Second,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, mockFeeder.CallsAddSku)
+	assert.Equal(t, 1, mockFeeder.CallsPersist)
+
+	<-idle
+	<-inLine
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// handoffEnv number of listeners a process inherits from the previous one (files from fd 3): the listeners of the
+// config followed by the http one when it is enabled. The file after them is the pipe where the snapshot of the
+// feeder is received and the next one the pipe where the new process tells it is ready.
+const handoffEnv = "FEEDER_HANDOFF_LISTENERS"
+
+// handoffReadyTimeout max time waiting for the new process to serve the listeners, when it is not ready the new
+// process is killed and this one keeps serving
+const handoffReadyTimeout = time.Second * 10
+
+// All errors reported by handoff
+var (
+	ErrHandoffListeners = errors.New("listeners inherited do not match the config")
+	ErrHandoffNotReady  = errors.New("new process did not serve the listeners")
+)
+
+// inherited listeners and pipes received by a process started by a handoff (see inheritedListeners)
+type inherited struct {
+	listeners []net.Listener // Listeners of the config.
+	http      net.Listener   // Nil when the http listener is not enabled.
+	snapshot  *os.File       // State of the feeder written by the previous process.
+	ready     *os.File       // Written once listeners are served, so the previous process can drain.
+}
+
+// handoff it will start a new process of the same binary with the listeners of this one, wait until it serves them
+// and then drain connections. The new process accepts connections right away, but their skus wait until it restores
+// the snapshot of the feeder, written by completeHandoff once this process released the rest of its addresses. When
+// the new process is not ready this one keeps serving.
+func (s *server) handoff() error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	listeners := s.openListeners
+	if s.httpListener != nil {
+		listeners = append(listeners[:len(listeners):len(listeners)], s.httpListener)
+	}
+
+	// files of the new process, closed in this one once it started
+	files := make([]*os.File, 0, len(listeners)+2)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.New("listener can't be handed off: " + l.Addr().String())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	files = append(files, r)
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"="+strconv.Itoa(len(listeners)))
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	log.Println("handing off to process", cmd.Process.Pid)
+
+	// without the copies of this process, the ready pipe is closed if the new process exits before being ready
+	for _, f := range files {
+		_ = f.Close()
+	}
+	files = nil
+
+	err = waitReady(readyR)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = w.Close()
+		return err
+	}
+
+	// unix sockets are removed when listeners are closed, but the new process keep using them
+	for _, l := range s.openListeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	s.handoffPipe = w
+	s.drain()
+
+	return nil
+}
+
+// waitReady it will wait until the new process tells it serves the listeners, for handoffReadyTimeout at most
+func waitReady(ready *os.File) error {
+	err := ready.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	if err != nil {
+		return err
+	}
+
+	_, err = ready.Read(make([]byte, 1))
+	if err != nil {
+		return ErrHandoffNotReady
+	}
+
+	return nil
+}
+
+// completeHandoff it will release the addresses of this process and send the snapshot of the feeder to the new one,
+// when it fails the new process continue with an empty state
+func (s *server) completeHandoff(release []func()) error {
+	defer s.handoffPipe.Close()
+
+	for _, r := range release {
+		r()
+	}
+
+	return s.feeder.Snapshot(s.handoffPipe)
+}
+
+// inheritedListeners return n listeners of the config (plus the http one when withHTTP is true) and the pipes
+// passed by the previous process, nil when the process was not started by a handoff
+func inheritedListeners(n int, withHTTP bool) (*inherited, error) {
+	v := os.Getenv(handoffEnv)
+	if v == "" {
+		return nil, nil
+	}
+	// processes started by this one must not inherit them
+	_ = os.Unsetenv(handoffEnv)
+
+	count, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, err
+	}
+	if withHTTP {
+		n++
+	}
+	if count != n {
+		return nil, ErrHandoffListeners
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		f := os.NewFile(uintptr(3+i), "listener")
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	in := &inherited{
+		listeners: listeners,
+		snapshot:  os.NewFile(uintptr(3+count), "snapshot"),
+		ready:     os.NewFile(uintptr(4+count), "ready"),
+	}
+	if withHTTP {
+		in.http = listeners[count-1]
+		in.listeners = listeners[:count-1]
+	}
+
+	return in, nil
+}
+
+// signalReady it will tell the previous process that listeners are served, so it starts draining
+func (in *inherited) signalReady() {
+	defer in.ready.Close()
+
+	_, err := in.ready.Write([]byte{1})
+	if err != nil {
+		log.Println("error telling the previous process it is ready", err)
+	}
+}
+
+// restore it will replace the state of the feeder with the snapshot sent by the previous process. When it fails the
+// run continue with an empty state, the previous process flushed its skus (see Start).
+func (s *server) restore(snapshot *os.File) {
+	defer snapshot.Close()
+
+	err := s.feeder.Restore(snapshot)
+	if err != nil {
+		log.Println("error restoring state from previous process", err)
+		return
+	}
+	log.Println("state restored from previous process")
+}
+
+// waitRestored it will wait until the state of the feeder is restored, false when the server stopped before
+func (s *server) waitRestored() bool {
+	select {
+	case <-s.restoredCh:
+		return true
+	case <-s.doneCh:
+		return false
+	}
+}
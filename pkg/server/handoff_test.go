@@ -0,0 +1,249 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"github.com/stretchr/testify/assert"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// handoffReportEnv report path of the test, the new process started by the handoff runs this test too
+const handoffReportEnv = "FEEDER_TEST_HANDOFF_REPORT"
+
+func TestServerHandoff(t *testing.T) {
+	path := os.Getenv(handoffReportEnv)
+	child := path != ""
+	if !child {
+		path = filepath.Join(t.TempDir(), "report.json")
+		_ = os.Setenv(handoffReportEnv, path)
+		defer os.Unsetenv(handoffReportEnv)
+
+		// the new process only runs this test
+		args := os.Args
+		os.Args = []string{args[0], "-test.run=^TestServerHandoff$"}
+		defer func() { os.Args = args }()
+	}
+
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5135",
+		KeepAlive:    time.Second * 10,
+		MaxConn:      2,
+		Session:      true,
+		Handoff:      true,
+		HTTPAddr:     "localhost:5136",
+		ReportFormat: "json",
+		ReportPath:   path,
+	}
+
+	srv := server.NewServer(cf, service.NewService(MockSkuRepository{}, MockLogger{}))
+
+	if child {
+		// the new process continue the run until the client terminate it
+		assert.Equal(t, server.ErrClientIndicateTerminate, srv.Start(ctx))
+		return
+	}
+
+	go func() {
+		conn, err := dial("localhost:5135")
+		assert.Nil(t, err)
+		exchange(t, conn, []string{"KASL-3423"}, []string{"OK"})
+		assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	}()
+
+	assert.Equal(t, server.ErrHandoff, srv.Start(ctx))
+
+	// same addresses, served by the new process with the state of this one
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:5136/skus", strings.NewReader("KASL-1111\n"))
+	assert.Nil(t, err)
+	res := postSkus(t, req, http.StatusOK)
+	assert.Equal(t, []server.ItemResult{{Sku: "KASL-1111", Status: "ACCEPTED"}}, res.Results)
+
+	conn, err := dial("localhost:5135")
+	assert.Nil(t, err)
+	exchange(t, conn, []string{"KASL-3423", "KASL-7770", "terminate"}, []string{"OK", "OK", "OK"})
+
+	var r service.Report
+	assert.Eventually(t, func() bool {
+		content, err := ioutil.ReadFile(path)
+		return err == nil && json.Unmarshal(content, &r) == nil
+	}, time.Second*10, time.Millisecond*50)
+	assert.EqualValues(t, 3, r.Unique)
+	assert.EqualValues(t, 1, r.Duplicated)
+	assert.Equal(t, server.ReasonTerminate, r.ShutdownReason)
+}
+
+func TestServerHandoffNotReady(t *testing.T) {
+	dir := os.Getenv(handoffReportEnv)
+	child := dir != ""
+	if !child {
+		dir = t.TempDir()
+		_ = os.Setenv(handoffReportEnv, dir)
+		defer os.Unsetenv(handoffReportEnv)
+
+		// the new process only runs this test
+		args := os.Args
+		os.Args = []string{args[0], "-test.run=^TestServerHandoffNotReady$"}
+		defer func() { os.Args = args }()
+	}
+
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5195",
+		KeepAlive:    time.Second * 10,
+		MaxConn:      2,
+		Session:      true,
+		Handoff:      true,
+		ReportFormat: "json",
+		ReportPath:   filepath.Join(dir, "report.json"),
+	}
+	exited := filepath.Join(dir, "exited")
+
+	if child {
+		// the new process fails before serving the listeners
+		cf.Listeners = []server.Listener{
+			{Network: "tcp", Address: "localhost:5195"},
+			{Network: "tcp", Address: "localhost:5196"},
+		}
+		srv := server.NewServer(cf, service.NewService(MockSkuRepository{}, MockLogger{}))
+		assert.Equal(t, server.ErrHandoffListeners, srv.Start(ctx))
+		assert.Nil(t, ioutil.WriteFile(exited, nil, 0600))
+		return
+	}
+
+	go func() {
+		conn, err := dial("localhost:5195")
+		assert.Nil(t, err)
+		exchange(t, conn, []string{"KASL-3423"}, []string{"OK"})
+		assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+		// connections are not drained, this process keeps serving them
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(exited)
+			return err == nil
+		}, time.Second*10, time.Millisecond*50)
+		exchange(t, conn, []string{"KASL-7770"}, []string{"OK"})
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	srv := server.NewServer(cf, service.NewService(MockSkuRepository{}, MockLogger{}))
+	assert.Equal(t, server.ErrClientIndicateTerminate, srv.Start(ctx))
+
+	var r service.Report
+	content, err := ioutil.ReadFile(filepath.Join(dir, "report.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.EqualValues(t, 2, r.Unique)
+	assert.Equal(t, server.ReasonTerminate, r.ShutdownReason)
+}
+
+type MockSkuRepository struct {
+}
+
+func (m MockSkuRepository) Persist(block map[string]value.Sku) (int64, error) {
+	return int64(len(block)), nil
+}
+
+func (m MockSkuRepository) Delete(block map[string]value.Sku) (int64, error) {
+	return 0, nil
+}
+
+type MockLogger struct {
+}
+
+func (m MockLogger) Log(v ...interface{}) {
+}
+
+func TestServerHandoffSnapshotFailed(t *testing.T) {
+	dir := os.Getenv(handoffReportEnv)
+	child := dir != ""
+	if !child {
+		dir = t.TempDir()
+		_ = os.Setenv(handoffReportEnv, dir)
+		defer os.Unsetenv(handoffReportEnv)
+
+		// the new process only runs this test
+		args := os.Args
+		os.Args = []string{args[0], "-test.run=^TestServerHandoffSnapshotFailed$"}
+		defer func() { os.Args = args }()
+	}
+
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5165",
+		KeepAlive:    time.Second * 10,
+		MaxConn:      2,
+		Session:      true,
+		Handoff:      true,
+		ReportFormat: "json",
+		ReportPath:   filepath.Join(dir, "parent.json"),
+	}
+
+	if child {
+		// the new process continue the run with an empty state
+		cf.ReportPath = filepath.Join(dir, "child.json")
+		srv := server.NewServer(cf, service.NewService(MockSkuRepository{}, MockLogger{}))
+		assert.Equal(t, server.ErrClientIndicateTerminate, srv.Start(ctx))
+		return
+	}
+
+	go func() {
+		conn, err := dial("localhost:5165")
+		assert.Nil(t, err)
+		exchange(t, conn, []string{"KASL-3423"}, []string{"OK"})
+		assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	}()
+
+	feeder := &failingSnapshotFeeder{Feeder: service.NewService(MockSkuRepository{}, MockLogger{})}
+	srv := server.NewServer(cf, feeder)
+	assert.EqualError(t, srv.Start(ctx), "snapshot failed")
+
+	// skus of this process are flushed when the snapshot can't be sent
+	var r service.Report
+	content, err := ioutil.ReadFile(filepath.Join(dir, "parent.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.EqualValues(t, 1, r.Unique)
+	assert.Equal(t, server.ReasonHandoff, r.ShutdownReason)
+
+	conn, err := dial("localhost:5165")
+	assert.Nil(t, err)
+	exchange(t, conn, []string{"KASL-3423", "terminate"}, []string{"OK", "OK"})
+
+	assert.Eventually(t, func() bool {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "child.json"))
+		return err == nil && json.Unmarshal(content, &r) == nil
+	}, time.Second*10, time.Millisecond*50)
+	assert.EqualValues(t, 1, r.Unique)
+	assert.EqualValues(t, 0, r.Duplicated)
+}
+
+// failingSnapshotFeeder feeder failing to write its snapshot
+type failingSnapshotFeeder struct {
+	service.Feeder
+}
+
+func (f *failingSnapshotFeeder) Snapshot(w io.Writer) error {
+	return errors.New("snapshot failed")
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"github.com/bernardosecades/feeder/pkg/auth"
+	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// providerHeader header sent by http clients to identify themselves as a provider (like 'HELLO <provider>')
+const providerHeader = "X-Provider"
+
+// httpShutdownTimeout max time waiting for requests in progress when the server stops
+const httpShutdownTimeout = time.Second * 5
+
+// httpHeaderTimeout max time receiving the headers of a request when ReadTimeout is not set
+const httpHeaderTimeout = time.Second * 10
+
+// DefaultHTTPBodyBytes max bytes of the body of a request when MaxConnBytes is not set
+const DefaultHTTPBodyBytes = 1 << 20
+
+// ItemResult result of a sku sent in 'POST /skus', Reason is the validation error code when it is invalid
+type ItemResult struct {
+	Sku    string `json:"sku"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// IngestResult reply of 'POST /skus' with the result of each sku in the same order they were sent
+type IngestResult struct {
+	Provider string       `json:"provider"`
+	Results  []ItemResult `json:"results"`
+}
+
+// serveHTTP start serving the http listener accepting skus in 'POST /skus', with TLS when it is enabled. ReadTimeout
+// limits the time receiving a whole request (headers are always limited) and IdleTimeout the time waiting for the
+// next one.
+func (s *server) serveHTTP(l net.Listener) (*http.Server, error) {
+	if s.cf.TLS != nil {
+		tlsConfig, err := s.cf.TLS.build()
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/skus", s.skusHandler)
+	headerTimeout := httpHeaderTimeout
+	if s.cf.ReadTimeout > 0 {
+		headerTimeout = s.cf.ReadTimeout
+	}
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: headerTimeout,
+		ReadTimeout:       s.cf.ReadTimeout,
+		IdleTimeout:       s.cf.IdleTimeout,
+	}
+
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("error serving http", err)
+		}
+	}()
+
+	return srv, nil
+}
+
+// shutdownHTTP it will stop the http listener waiting for requests in progress
+func shutdownHTTP(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Println("error stopping http listener", err)
+	}
+}
+
+// skusHandler it will add each sku of the body (a json array of strings or one sku per line) with the feeder. Each
+// request takes one of the MaxConn slots while it is handled, if there is no free slot it is rejected. Like tcp
+// clients, the body is limited to MaxConnBytes (DefaultHTTPBodyBytes when it is not set), skus longer than
+// MaxLineLength are discarded and rate limits are applied to each sku.
+func (s *server) skusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorReply{Error: "only POST is allowed"})
+		return
+	}
+
+	provider, status := s.httpProvider(r)
+	if status != http.StatusOK {
+		writeJSON(w, status, errorReply{Error: http.StatusText(status)})
+		return
+	}
+
+	select {
+	case s.connCh <- true:
+		defer func() { <-s.connCh }()
+	default:
+		s.metrics.rejected.Inc()
+		writeJSON(w, http.StatusServiceUnavailable, errorReply{Error: "limit connections reached"})
+		return
+	}
+
+	// the body is read while the request holds the slot, so it is always limited
+	limit := int64(DefaultHTTPBodyBytes)
+	if s.cf.MaxConnBytes > 0 {
+		limit = s.cf.MaxConnBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	skus, err := decodeSkus(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorReply{Error: err.Error()})
+		return
+	}
+
+	// rate limits of the request are like the ones of a tcp connection
+	c := &client{provider: provider, bucket: s.limiter.connBucket()}
+
+	results := make([]ItemResult, 0, len(skus))
+	for _, sku := range skus {
+		s.metrics.lines.Inc()
+		if s.limiter.throttle(c, s.drainCh) {
+			results = append(results, ItemResult{Sku: sku, Status: codeThrottled})
+			continue
+		}
+
+		var outcome service.Outcome
+		if s.cf.MaxLineLength > 0 && len(sku) > s.cf.MaxLineLength {
+			sku = sku[:s.cf.MaxLineLength]
+			outcome = s.feeder.Discard(provider, sku, value.ErrLineTooLong)
+		} else {
+			outcome = s.feeder.AddSkuFrom(provider, sku)
+		}
+		code, reason := outcomeCode(outcome)
+		results = append(results, ItemResult{Sku: sku, Status: code, Reason: reason})
+	}
+
+	writeJSON(w, http.StatusOK, IngestResult{Provider: provider, Results: results})
+}
+
+// httpProvider it will identify the provider of the request like tcp clients: client certificate, token, header
+// X-Provider or address. When authentication is enabled it return the http status if the request is refused.
+func (s *server) httpProvider(r *http.Request) (string, int) {
+	provider := ""
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		provider = s.providers.lookup(addr)
+	}
+	if p := r.Header.Get(providerHeader); p != "" {
+		provider = s.hello.name(p)
+	}
+
+	if s.tokens != nil {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		identity, ok := s.tokens.Authenticate(token)
+		if !ok {
+			log.Println("client not authenticated", r.RemoteAddr)
+			atomic.AddInt64(&s.unauthenticated, 1)
+			s.metrics.unauthenticated.Inc()
+			return "", http.StatusUnauthorized
+		}
+		if !identity.Can(auth.PermSendSkus) {
+			return "", http.StatusForbidden
+		}
+		provider = identity.Provider
+	}
+
+	if r.TLS != nil {
+		if p, ok := stateProvider(*r.TLS); ok {
+			provider = p
+		}
+	}
+
+	return provider, http.StatusOK
+}
+
+// decodeSkus it will return skus of the body: a json array of strings, or one sku per line (empty lines ignored)
+func decodeSkus(r *http.Request) ([]string, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	body = bytes.TrimSpace(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") || bytes.HasPrefix(body, []byte("[")) {
+		var skus []string
+		err = json.Unmarshal(body, &skus)
+		return skus, err
+	}
+
+	skus := []string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			skus = append(skus, line)
+		}
+	}
+
+	return skus, nil
+}
+
+// writeJSON it will write the reply as json with the status
+func writeJSON(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("error writing http reply", err)
+	}
+}
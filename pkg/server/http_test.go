@@ -0,0 +1,157 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerHTTPIngestion(t *testing.T) {
+	go func() {
+		// wait for the http listener
+		conn, err := dial("localhost:5096")
+		assert.Nil(t, err)
+		assert.Nil(t, conn.Close())
+
+		// one sku per line
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:5096/skus",
+			strings.NewReader("KASL-3423\r\nKASL-3423\n\nKASL*3423\n"))
+		assert.Nil(t, err)
+		req.Header.Set("X-Provider", "acme")
+		res := postSkus(t, req, http.StatusOK)
+		assert.Equal(t, server.IngestResult{
+			Provider: "acme",
+			Results: []server.ItemResult{
+				{Sku: "KASL-3423", Status: "ACCEPTED"},
+				{Sku: "KASL-3423", Status: "DUPLICATE"},
+				{Sku: "KASL*3423", Status: "INVALID", Reason: "SEPARATOR"},
+			},
+		}, res)
+
+		// json array, it shares de-duplication with the tcp listener
+		req, err = http.NewRequest(http.MethodPost, "http://localhost:5096/skus",
+			strings.NewReader(`["KASL-7770", "KASL-3423"]`))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		res = postSkus(t, req, http.StatusOK)
+		assert.Equal(t, []server.ItemResult{
+			{Sku: "KASL-7770", Status: "ACCEPTED"},
+			{Sku: "KASL-3423", Status: "DUPLICATE"},
+		}, res.Results)
+
+		// tcp client takes the unique slot, so http requests are rejected
+		conn, err = dial("localhost:5095")
+		assert.Nil(t, err)
+		buf := bufio.NewReader(conn)
+		_, err = conn.Write([]byte("KASL-1111\n"))
+		assert.Nil(t, err)
+		_, err = buf.ReadString('\n')
+		assert.Nil(t, err)
+
+		req, err = http.NewRequest(http.MethodPost, "http://localhost:5096/skus", strings.NewReader("KASL-2222\n"))
+		assert.Nil(t, err)
+		postSkus(t, req, http.StatusServiceUnavailable)
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5095",
+		KeepAlive: time.Second * 2,
+		MaxConn:   1,
+		Session:   true,
+		HTTPAddr:  "localhost:5096",
+	}
+
+	seen := map[string]bool{}
+	mockFeeder := &MockFeeder{fnAddSku: func(sku string) service.Outcome {
+		if _, err := value.NewSku(sku); err != nil {
+			return service.Outcome{Status: service.Invalid, Reason: err}
+		}
+		if seen[sku] {
+			return service.Outcome{Status: service.Duplicated}
+		}
+		seen[sku] = true
+		return service.Outcome{Status: service.Accepted}
+	}}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	assert.Equal(t, 6, mockFeeder.CallsAddSku)
+}
+
+func TestServerHTTPLimits(t *testing.T) {
+	go func() {
+		// wait for the http listener
+		conn, err := dial("localhost:5171")
+		assert.Nil(t, err)
+		assert.Nil(t, conn.Close())
+
+		// body is limited even if MaxConnBytes is not set
+		body := strings.Repeat("KASL-3423\n", server.DefaultHTTPBodyBytes/10+1)
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:5171/skus", strings.NewReader(body))
+		assert.Nil(t, err)
+		postSkus(t, req, http.StatusBadRequest)
+
+		// a client sending the headers slowly is disconnected after ReadTimeout
+		conn, err = dial("localhost:5171")
+		assert.Nil(t, err)
+		_, err = conn.Write([]byte("POST /skus HTTP/1.1\r\n"))
+		assert.Nil(t, err)
+		start := time.Now()
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		assert.NotNil(t, err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:    "tcp",
+		Host:        "",
+		Port:        "5170",
+		KeepAlive:   time.Second * 1,
+		MaxConn:     1,
+		HTTPAddr:    "localhost:5171",
+		ReadTimeout: time.Millisecond * 200,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, mockFeeder.CallsAddSku)
+}
+
+// postSkus it will send the request and decode the reply checking its status
+func postSkus(t *testing.T, req *http.Request, status int) server.IngestResult {
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, status, resp.StatusCode)
+
+	var res server.IngestResult
+	if status == http.StatusOK {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	}
+
+	return res
+}
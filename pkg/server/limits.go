@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// Errors reported reading lines of a client
+var (
+	errLineTooLong    = errors.New("line too long")
+	errBudgetExceeded = errors.New("byte budget exceeded")
+)
+
+// budgetReader reader failing with errBudgetExceeded once more than the budget of bytes is read
+type budgetReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, errBudgetExceeded
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+
+	return n, err
+}
+
+// newReader it will return the reader of the lines of the client, limited to MaxConnBytes when it is set
+func (s *server) newReader(c *client) *bufio.Reader {
+	if s.cf.MaxConnBytes > 0 {
+		return bufio.NewReader(&budgetReader{r: c.conn, remaining: s.cf.MaxConnBytes})
+	}
+
+	return bufio.NewReader(c.conn)
+}
+
+// readString it will read until the newline. When MaxLineLength is set longer lines are discarded until the next
+// newline, it returns errLineTooLong with the first MaxLineLength bytes, so memory used by a line is bounded.
+func (s *server) readString(buf *bufio.Reader) (string, error) {
+	if s.cf.MaxLineLength <= 0 {
+		return buf.ReadString('\n')
+	}
+
+	var line []byte
+	read := 0
+	for {
+		chunk, err := buf.ReadSlice('\n')
+		read += len(chunk)
+		// room for the max length plus "\r\n" to know later if the line is too long
+		if room := s.cf.MaxLineLength + 2 - len(line); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			line = append(line, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if read > len(line) {
+		return string(line[:s.cf.MaxLineLength]), errLineTooLong
+	}
+	if text := trimNewline(string(line)); len(text) > s.cf.MaxLineLength {
+		return text[:s.cf.MaxLineLength], errLineTooLong
+	}
+
+	return string(line), nil
+}
+
+// trimNewline remove the newline ("\n" or "\r\n") at the end of the line
+func trimNewline(line string) string {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return line
+}
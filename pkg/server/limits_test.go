@@ -0,0 +1,80 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerMaxLineLengthAndByteBudget(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+
+		conn, err := dial("localhost:5110")
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(conn)
+		cases := []struct {
+			line  string
+			reply string
+		}{
+			{"KASL-3423\n", "ACCEPTED\n"},
+			{strings.Repeat("A", 5000) + "\n", "INVALID LINE_TOO_LONG\n"}, // longer than the buffer of the reader
+			{"KASL-7770\r\n", "ACCEPTED\n"},                               // next line is read after the discarded one
+		}
+		for _, c := range cases {
+			_, err = conn.Write([]byte(c.line))
+			assert.Nil(t, err)
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, c.reply, reply)
+		}
+
+		// 5022 bytes sent until now, so only 7 of these lines fit in the budget
+		_, err = conn.Write([]byte(strings.Repeat("KASL-1111\n", 10)))
+		assert.Nil(t, err)
+		for i := 0; i < 7; i++ {
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, "ACCEPTED\n", reply)
+		}
+
+		reply, err := buf.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "byte budget exceeded\n", reply)
+		// connection is closed (reset as the server does not read the rest of the lines)
+		_, err = buf.ReadString('\n')
+		assert.NotNil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:      "tcp",
+		Host:          "",
+		Port:          "5110",
+		KeepAlive:     time.Millisecond * 500,
+		MaxConn:       1,
+		Session:       true,
+		ResponseCodes: true,
+		MaxLineLength: 12,
+		MaxConnBytes:  5100,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	<-done
+	assert.Equal(t, 1, mockFeeder.CallsDiscard)
+	assert.Equal(t, 9, mockFeeder.CallsAddSku)
+}
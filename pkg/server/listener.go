@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// All errors reported by listeners
+var (
+	ErrSocketInUse = errors.New("address in use by another process")
+)
+
+// Listener address where the server accept clients
+type Listener struct {
+	// Network tcp, tcp4, tcp6 or unix
+	Network string
+	// Address host:port (use net.JoinHostPort) or path of the socket for unix
+	Address string
+	// Mode permissions of the unix socket (zero keeps the default of the system)
+	Mode os.FileMode
+}
+
+// listeners return listeners of the config, or the one of Protocol, Host and Port when there is none
+func (s *server) listeners() []Listener {
+	if len(s.cf.Listeners) > 0 {
+		return s.cf.Listeners
+	}
+
+	return []Listener{{Network: s.cf.Protocol, Address: net.JoinHostPort(s.cf.Host, s.cf.Port)}}
+}
+
+// listen it will start listening in the address, for unix sockets it removes the socket of a previous run (e.g.:
+// it crashed) and set its permissions
+func listen(cf Listener) (net.Listener, error) {
+	if cf.Network == "unix" {
+		err := removeStaleSocket(cf.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(cf.Network, cf.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if cf.Network == "unix" && cf.Mode != 0 {
+		err = os.Chmod(cf.Address, cf.Mode)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket it will remove the unix socket in path if exists and nobody is listening in it (the connection
+// is refused), other files are never removed. It returns ErrSocketInUse when another process accepts connections.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		log.Println("error removing stale socket", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerMultipleListeners(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "feeder.sock")
+
+	go func() {
+		local, err := dialNetwork("unix", socket)
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(local)
+		_, err = local.Write([]byte("KASL-3423\n"))
+		assert.Nil(t, err)
+		reply, err := buf.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "OK\n", reply)
+
+		info, err := os.Stat(socket)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		// the unix client takes the unique slot shared by both listeners
+		remote, err := dial("localhost:5100")
+		assert.Nil(t, err)
+		reply, err = bufio.NewReader(remote).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "limit connections reached\n", reply)
+
+		_, err = local.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		KeepAlive: time.Second * 2,
+		MaxConn:   1,
+		Session:   true,
+		Listeners: []server.Listener{
+			{Network: "tcp", Address: "localhost:5100"},
+			{Network: "unix", Address: socket, Mode: 0600},
+		},
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	assert.Equal(t, 1, mockFeeder.CallsAddSku)
+}
+
+func TestServerUnixSocketInUse(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "feeder.sock")
+	cf := server.Config{
+		KeepAlive: time.Millisecond * 100,
+		MaxConn:   1,
+		Session:   true,
+		Listeners: []server.Listener{{Network: "unix", Address: socket}},
+	}
+
+	// another process accepts connections in the socket
+	other, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+
+	err = server.NewServer(cf, &MockFeeder{}).Start(context.Background())
+	assert.True(t, errors.Is(err, server.ErrSocketInUse))
+	_, err = os.Stat(socket)
+	assert.Nil(t, err)
+
+	// socket of a previous run that crashed is replaced
+	other.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.Nil(t, other.Close())
+
+	err = server.NewServer(cf, &MockFeeder{}).Start(context.Background())
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
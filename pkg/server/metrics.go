@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/bernardosecades/feeder/pkg/metrics"
+
+	"log"
+	"net"
+	"net/http"
+)
+
+// serverMetrics metrics of the server exposed for prometheus
+type serverMetrics struct {
+	registry        *metrics.Registry
+	rejected        *metrics.Counter
+	unauthenticated *metrics.Counter
+	timedOut        *metrics.Counter
+	throttled       *metrics.Counter
+	lines           *metrics.Counter
+	persistDuration *metrics.Histogram
+	persistErrors   *metrics.Counter
+}
+
+// newServerMetrics register metrics of the server, counters of skus are taken from the feeder report
+func newServerMetrics(s *server) *serverMetrics {
+	r := metrics.NewRegistry()
+
+	r.NewGaugeFunc("feeder_active_connections", "Number of clients connected.", func() float64 {
+		return float64(len(s.connCh))
+	})
+	r.NewGaugeFunc("feeder_unique_skus", "Number of unique skus received in current window.", func() float64 {
+		return float64(s.feeder.Report().Unique)
+	})
+	r.NewGaugeFunc("feeder_duplicated_skus", "Number of duplicated skus received in current window.", func() float64 {
+		return float64(s.feeder.Report().Duplicated)
+	})
+	r.NewGaugeFunc("feeder_invalid_skus", "Number of invalid skus received in current window.", func() float64 {
+		return float64(s.feeder.Report().Invalid)
+	})
+
+	return &serverMetrics{
+		registry:        r,
+		rejected:        r.NewCounter("feeder_rejected_connections_total", "Number of connections rejected."),
+		unauthenticated: r.NewCounter("feeder_unauthenticated_connections_total", "Number of connections refused by authentication."),
+		timedOut:        r.NewCounter("feeder_timed_out_connections_total", "Number of connections closed by a deadline."),
+		throttled:       r.NewCounter("feeder_throttled_lines_total", "Number of lines delayed or refused by rate limits."),
+		lines:           r.NewCounter("feeder_lines_received_total", "Number of lines received from clients."),
+		persistDuration: r.NewHistogram("feeder_persist_duration_seconds", "Time persisting skus in storage.", metrics.DefaultBuckets),
+		persistErrors:   r.NewCounter("feeder_persist_errors_total", "Number of errors persisting skus in storage."),
+	}
+}
+
+// serve start http listener exposing metrics in /metrics
+func (m *serverMetrics) serve(addr string) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.registry.Handler())
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("error serving metrics", err)
+		}
+	}()
+
+	return srv, nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// helloCommand line sent by a client to identify itself as a provider
+const helloCommand = "HELLO "
+
+// authCommand first line sent by a client to authenticate with a token when authentication is enabled
+const authCommand = "AUTH "
+
+// DefaultMaxProviders max distinct providers not configured that clients can send when the config does not set it
+const DefaultMaxProviders = 100
+
+// provider network of a provider
+type provider struct {
+	network *net.IPNet
+	name    string
+}
+
+// providers networks of known providers
+type providers []provider
+
+// newProviders parse IPs or CIDRs of providers, invalid ones are logged and ignored
+func newProviders(cf map[string]string) providers {
+	p := providers{}
+	for addr, name := range cf {
+		if !strings.Contains(addr, "/") {
+			if strings.Contains(addr, ":") {
+				addr += "/128"
+			} else {
+				addr += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			log.Println("invalid provider address", addr, err)
+			continue
+		}
+
+		p = append(p, provider{network: network, name: name})
+	}
+
+	return p
+}
+
+// lookup return provider of the most specific network containing the address (empty if none)
+func (p providers) lookup(addr net.Addr) string {
+	ip := addrIP(addr)
+
+	name := ""
+	longest := -1
+	for _, pv := range p {
+		ones, _ := pv.network.Mask.Size()
+		if pv.network.Contains(ip) && ones > longest {
+			name = pv.name
+			longest = ones
+		}
+	}
+
+	return name
+}
+
+// helloProviders providers sent by clients with HELLO (or the header X-Provider), the ones not configured are limited
+// so clients can't grow the providers of the report and rate limits without bound
+type helloProviders struct {
+	mx         sync.Mutex
+	configured map[string]bool
+	names      map[string]bool
+	max        int
+}
+
+func newHelloProviders(cf map[string]string, max int) *helloProviders {
+	if max <= 0 {
+		max = DefaultMaxProviders
+	}
+
+	h := &helloProviders{configured: map[string]bool{}, names: map[string]bool{}, max: max}
+	for _, name := range cf {
+		h.configured[name] = true
+	}
+
+	return h
+}
+
+// name return the provider sent by a client, empty (unknown) when it is not configured and the limit of providers
+// was reached
+func (h *helloProviders) name(provider string) string {
+	if h.configured[provider] {
+		return provider
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if !h.names[provider] {
+		if len(h.names) >= h.max {
+			log.Println("provider counted as unknown, limit of providers reached", provider)
+			return ""
+		}
+		h.names[provider] = true
+	}
+
+	return provider
+}
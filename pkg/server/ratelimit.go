@@ -0,0 +1,139 @@
+package server
+
+import (
+	"github.com/bernardosecades/feeder/pkg/metrics"
+	"github.com/bernardosecades/feeder/pkg/ratelimit"
+
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies when a client exceeds a rate limit
+const (
+	ThrottleBackpressure = "backpressure" // Stop reading the client until it is allowed (default).
+	ThrottleReply        = "reply"        // Reply 'THROTTLED' and discard the line.
+)
+
+// All errors reported by rate limits
+var (
+	ErrThrottlePolicy = errors.New("unknown throttle policy, should be 'backpressure' or 'reply'")
+)
+
+// RateLimit lines per second allowed with bursts of Burst lines
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// limiter rate limits of connections and providers
+type limiter struct {
+	conn      *RateLimit
+	provider  *RateLimit
+	policy    string
+	mx        sync.Mutex
+	providers map[string]*ratelimit.Bucket
+	throttled int64 // Lines throttled in current window (only modified with atomic).
+	metric    *metrics.Counter
+}
+
+func newLimiter(cf Config, metric *metrics.Counter) *limiter {
+	return &limiter{
+		conn:      cf.ConnRateLimit,
+		provider:  cf.ProviderRateLimit,
+		policy:    cf.ThrottlePolicy,
+		providers: map[string]*ratelimit.Bucket{},
+		metric:    metric,
+	}
+}
+
+// validate check the policy is known
+func (l *limiter) validate() error {
+	if l.policy != "" && l.policy != ThrottleBackpressure && l.policy != ThrottleReply {
+		return ErrThrottlePolicy
+	}
+
+	return nil
+}
+
+// connBucket return a bucket for a new connection (nil without limit per connection)
+func (l *limiter) connBucket() *ratelimit.Bucket {
+	if l.conn == nil {
+		return nil
+	}
+
+	return ratelimit.NewBucket(l.conn.Rate, l.conn.Burst)
+}
+
+// providerBucket return the bucket shared by connections of the provider (nil without limit per provider)
+func (l *limiter) providerBucket(provider string) *ratelimit.Bucket {
+	if l.provider == nil {
+		return nil
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	b, ok := l.providers[provider]
+	if !ok {
+		b = ratelimit.NewBucket(l.provider.Rate, l.provider.Burst)
+		l.providers[provider] = b
+	}
+
+	return b
+}
+
+// throttle it will apply rate limits of the client to a line: with backpressure policy it waits until the line is
+// allowed (or done is closed), with reply policy it return true when the line must be refused. Lines delayed or
+// refused are counted.
+func (l *limiter) throttle(c *client, done <-chan struct{}) bool {
+	buckets := []*ratelimit.Bucket{c.bucket, l.providerBucket(c.provider)}
+
+	if l.policy == ThrottleReply {
+		for _, b := range buckets {
+			if b != nil && !b.Allow() {
+				l.count()
+				return true
+			}
+		}
+		return false
+	}
+
+	var wait time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if w := b.Reserve(); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		l.count()
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+		}
+	}
+
+	return false
+}
+
+// count it will count a line throttled
+func (l *limiter) count() {
+	atomic.AddInt64(&l.throttled, 1)
+	l.metric.Inc()
+}
+
+// swap return lines throttled and reset the counter for the next window
+func (l *limiter) swap() int {
+	return int(atomic.SwapInt64(&l.throttled, 0))
+}
+
+// load return lines throttled without resetting the counter
+func (l *limiter) load() int {
+	return int(atomic.LoadInt64(&l.throttled))
+}
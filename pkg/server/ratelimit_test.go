@@ -0,0 +1,148 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+	"github.com/bernardosecades/feeder/pkg/service"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerRateLimitsReply(t *testing.T) {
+	go func() {
+		// fourth sku is over the limit of the connection, commands are not throttled
+		conn, err := dial("localhost:5115")
+		assert.Nil(t, err)
+		exchange(t, conn, []string{"HELLO acme", "KASL-3423", "KASL-3424", "KASL-3425", "KASL-3426"},
+			[]string{"OK", "OK", "OK", "OK", "THROTTLED"})
+
+		// connection of the same provider is over the limit of the provider
+		conn, err = dial("localhost:5115")
+		assert.Nil(t, err)
+		exchange(t, conn, []string{"HELLO acme", "KASL-3427"},
+			[]string{"OK", "THROTTLED"})
+
+		conn, err = dial("localhost:5115")
+		assert.Nil(t, err)
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "report.json")
+	cf := server.Config{
+		Protocol:          "tcp",
+		Host:              "",
+		Port:              "5115",
+		KeepAlive:         time.Second * 2,
+		MaxConn:           3,
+		Session:           true,
+		ReportFormat:      "json",
+		ReportPath:        path,
+		ConnRateLimit:     &server.RateLimit{Rate: 0.1, Burst: 3},
+		ProviderRateLimit: &server.RateLimit{Rate: 0.1, Burst: 3},
+		ThrottlePolicy:    server.ThrottleReply,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	// lines throttled are not added
+	assert.Equal(t, 3, mockFeeder.CallsAddSku)
+	assert.Equal(t, 2, readReport(t, path).Throttled)
+}
+
+func TestServerRateLimitsBackpressure(t *testing.T) {
+	var elapsed time.Duration
+	go func() {
+		conn, err := dial("localhost:5120")
+		assert.Nil(t, err)
+
+		// one line each 50ms after the first one
+		start := time.Now()
+		exchange(t, conn, []string{"KASL-3423", "KASL-3424", "KASL-3425", "KASL-3426", "KASL-3427"},
+			[]string{"OK", "OK", "OK", "OK", "OK"})
+		elapsed = time.Since(start)
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "report.json")
+	cf := server.Config{
+		Protocol:      "tcp",
+		Host:          "",
+		Port:          "5120",
+		KeepAlive:     time.Second * 2,
+		MaxConn:       1,
+		Session:       true,
+		ReportFormat:  "json",
+		ReportPath:    path,
+		ConnRateLimit: &server.RateLimit{Rate: 20, Burst: 1},
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	assert.Equal(t, 5, mockFeeder.CallsAddSku)
+	assert.True(t, elapsed >= time.Millisecond*190, elapsed)
+	// skus were delayed, terminate is a command so it is not
+	assert.Equal(t, 4, readReport(t, path).Throttled)
+}
+
+func TestServerUnknownThrottlePolicy(t *testing.T) {
+	cf := server.Config{
+		Protocol:       "tcp",
+		Host:           "",
+		Port:           "5125",
+		KeepAlive:      time.Millisecond * 10,
+		MaxConn:        1,
+		ThrottlePolicy: "drop",
+	}
+
+	srv := server.NewServer(cf, &MockFeeder{})
+
+	assert.Equal(t, server.ErrThrottlePolicy, srv.Start(context.Background()))
+}
+
+// exchange it will send all lines in one write and check replies
+func exchange(t *testing.T, conn net.Conn, lines []string, replies []string) {
+	_, err := conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	assert.Nil(t, err)
+
+	buf := bufio.NewReader(conn)
+	for _, expected := range replies {
+		reply, err := buf.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, expected+"\n", reply)
+	}
+}
+
+// readReport it will read the json report written by the server
+func readReport(t *testing.T, path string) service.Report {
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	var r service.Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+
+	return r
+}
@@ -1,22 +1,46 @@
 package server
 
 import (
+	"github.com/bernardosecades/feeder/pkg/auth"
+	"github.com/bernardosecades/feeder/pkg/ratelimit"
+	"github.com/bernardosecades/feeder/pkg/report"
 	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/value"
 
-	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var (
 	ErrClientIndicateTerminate = errors.New("client indicate 'terminate'")
+	ErrAdminShutdown           = errors.New("admin indicate 'SHUTDOWN'")
+	ErrHandoff                 = errors.New("server handed off to a new process")
+)
+
+// Reasons why a run (or window in daemon mode) finished, included in reports
+const (
+	ReasonTimeout   = "timeout"
+	ReasonSignal    = "signal"
+	ReasonTerminate = "terminate"
+	ReasonWindow    = "window"
+	ReasonFlush     = "flush"
+	ReasonShutdown  = "shutdown"
+	ReasonHandoff   = "handoff"
 )
 
 // Config pending text
@@ -26,6 +50,80 @@ type Config struct {
 	Port      string
 	KeepAlive time.Duration
 	MaxConn   int
+	// Session keeps the connection open after each line so a client can send any number of skus, each one
+	// acknowledged with "OK". When false the server replies to the first line and closes the connection.
+	Session bool
+	// IdleTimeout closes the connection when the client does not start a new line in that time (zero means no
+	// timeout).
+	IdleTimeout time.Duration
+	// ReadTimeout closes the connection when the client does not finish a line (newline) in that time since it
+	// started sending it (zero means no timeout).
+	ReadTimeout time.Duration
+	// MaxSessionDuration closes the connection after that time since it was accepted (zero means no limit).
+	MaxSessionDuration time.Duration
+	// MaxLineLength max bytes of a line (without newline), longer lines are discarded until the next newline and
+	// counted as invalid with code LINE_TOO_LONG (zero means no limit).
+	MaxLineLength int
+	// MaxConnBytes max bytes a client can send in a connection, then it is disconnected (zero means no limit).
+	MaxConnBytes int64
+	// ConnRateLimit lines per second allowed to each connection (nil means no limit).
+	ConnRateLimit *RateLimit
+	// ProviderRateLimit lines per second allowed to each provider, shared by all its connections (nil means no limit).
+	ProviderRateLimit *RateLimit
+	// DrainTimeout time waiting for clients to finish the line they are sending when the server stops, then their
+	// connections are closed (zero closes them right away).
+	DrainTimeout time.Duration
+	// ThrottlePolicy what to do with lines over the rate limits: ThrottleBackpressure (default) or ThrottleReply.
+	ThrottlePolicy string
+	// QueueLen is the max number of connections waiting for a free slot when MaxConn is reached, served in
+	// FIFO order. Zero disables the queue and connections over the limit are rejected.
+	QueueLen int
+	// QueueWait is the max time a connection can wait in the queue (zero means wait until a slot is free).
+	QueueWait time.Duration
+	// FlushInterval enables daemon mode: the server never times out and every FlushInterval it closes a window
+	// logging, reporting and persisting the skus received in that window and resetting the counters.
+	FlushInterval time.Duration
+	// ResponseCodes reply to each sku with ACCEPTED, DUPLICATE or INVALID <code> (code of the validation error)
+	// instead of OK.
+	ResponseCodes bool
+	// MetricsAddr address of the http listener exposing prometheus metrics in /metrics (empty disables it)
+	MetricsAddr string
+	// ReportFormat format of the report written when the run (or window) finish: text (default), json or csv.
+	ReportFormat string
+	// ReportPath file where reports are appended (empty means stdout).
+	ReportPath string
+	// Providers map IP or CIDR (e.g.: 10.0.0.0/8) of clients to provider names, the most specific one is used.
+	// Clients can identify themselves too sending 'HELLO <provider>'.
+	Providers map[string]string
+	// MaxProviders max distinct providers not in Providers that clients can send with 'HELLO <provider>', skus of
+	// next ones are attributed to unknown (zero means DefaultMaxProviders).
+	MaxProviders int
+	// TLS encrypt connections with TLS (nil means plain TCP)
+	TLS *TLSConfig
+	// AuthTokensFile enables authentication: first line of each connection must be 'AUTH <token>' with one of the
+	// tokens in this file (see auth.LoadTokens), which set the provider and permissions of the client.
+	AuthTokensFile string
+	// Terminate policy of clients allowed to stop the server sending 'terminate' (nil means any client)
+	Terminate *TerminatePolicy
+	// AdminAddr address of the admin listener (empty disables it): host:port or unix:<path> for a unix socket
+	AdminAddr string
+	// AdminToken secret admin clients must send as 'AUTH <token>' before any command, required when AdminAddr is a
+	// tcp address
+	AdminToken string
+	// Listeners addresses where clients are accepted, all of them share the MaxConn slots. When empty the server
+	// listen in Protocol, Host and Port.
+	Listeners []Listener
+	// HTTPAddr address of the http listener accepting skus in 'POST /skus' (empty disables it). It shares the feeder
+	// and the MaxConn slots with the tcp listener.
+	HTTPAddr string
+	// Handoff enables restarts without downtime: on SIGHUP or SIGUSR2 the server starts a new process of the same
+	// binary, passing it the listeners and the state of the feeder, and stops once connections are drained.
+	Handoff bool
+	// SnapshotPath file where the state of the feeder is saved every SnapshotInterval (empty disables it). A run that
+	// did not finish (e.g.: a planned restart) continues from it, it is removed once the run is persisted.
+	SnapshotPath string
+	// SnapshotInterval time between snapshots (zero only restores it when the server starts)
+	SnapshotInterval time.Duration
 }
 
 type Server interface {
@@ -34,82 +132,399 @@ type Server interface {
 
 // Server pending text
 type server struct {
-	cf     Config
-	feeder service.Feeder
-	stopCh chan bool // To control input "terminate" and disconnect all clients and perform a clean shutdown.
-	connCh chan bool // Semaphore to control max concurrency in connections (with buffered channel).
+	cf      Config
+	feeder  service.Feeder
+	stopCh  chan bool       // To control input "terminate" and disconnect all clients and perform a clean shutdown.
+	drainCh chan struct{}   // Closed when the server starts draining connections to stop.
+	connCh  chan bool       // Semaphore to control max concurrency in connections (with buffered channel).
+	queueCh chan queuedConn // FIFO of connections waiting for a free slot in connCh.
+	queued  int32           // Connections in queueCh plus the one waiting in dispatch (only modified with atomic).
+
+	flushCh    chan chan flushResult // FLUSH requests from the admin listener, handled by Start.
+	shutdownCh chan bool             // SHUTDOWN requests from the admin listener.
+	doneCh     chan struct{}         // Closed when Start returns, so admin requests are not waiting forever.
+	startedAt  time.Time
+	clients    *clients // Connections being handled, listed by the admin command CONNECTIONS.
+
+	openListeners []net.Listener // Closed when draining to stop accepting connections.
+	httpServer    *http.Server
+	httpListener  net.Listener // Handed off with openListeners, it is closed by httpServer.
+	cancelConns   context.CancelFunc
+	handoffPipe   *os.File      // Snapshot of the feeder is written here for the new process (see handoff).
+	restoredCh    chan struct{} // Closed once the state of the feeder is restored, skus wait for it.
+
+	runID        string // Identifier of the run included in reports.
+	reportWriter report.Writer
+	metrics      *serverMetrics
+	providers    providers
+	hello        *helloProviders
+	tokens       *auth.Tokens // nil when authentication is disabled
+
+	terminatePolicy *terminatePolicy
+	audit           *auditLog
+
+	unauthenticated int64 // Connections refused by authentication in current window (only modified with atomic).
+	timeouts        timeouts
+	limiter         *limiter
+}
+
+// queuedConn connection waiting in the queue for a free slot
+type queuedConn struct {
+	conn     net.Conn
+	queuedAt time.Time
 }
 
 // NewServer create new instance of server with config and service
 func NewServer(cf Config, feeder service.Feeder) Server {
-	return &server{
-		cf:     cf,
-		feeder: feeder,
-		stopCh: make(chan bool),
-		connCh: make(chan bool, cf.MaxConn),
+	s := &server{
+		cf:      cf,
+		feeder:  feeder,
+		stopCh:  make(chan bool),
+		drainCh: make(chan struct{}),
+		connCh:  make(chan bool, cf.MaxConn),
+		queueCh: make(chan queuedConn, cf.QueueLen),
+		runID:   newRunID(),
+
+		flushCh:    make(chan chan flushResult),
+		shutdownCh: make(chan bool),
+		doneCh:     make(chan struct{}),
+		restoredCh: make(chan struct{}),
+		clients:    newClients(),
 	}
+	s.providers = newProviders(cf.Providers)
+	s.hello = newHelloProviders(cf.Providers, cf.MaxProviders)
+	s.terminatePolicy = newTerminatePolicy(cf.Terminate)
+	s.metrics = newServerMetrics(s)
+	s.limiter = newLimiter(cf, s.metrics.throttled)
+
+	return s
 }
 
-// Start start the server and running until detect timeout/cancel signals and 'terminate' message from some client
+// Start start the server and running until detect timeout/cancel signals and 'terminate' message from some client.
+// In daemon mode (FlushInterval greater than zero) KeepAlive is ignored and the server runs until a signal or
+// 'terminate' message, closing a window every FlushInterval.
 func (s *server) Start(ctx context.Context) error {
-	defer close(s.stopCh)
-	defer close(s.connCh)
+	defer close(s.doneCh)
+	s.startedAt = time.Now()
 
 	ctx, cancelSignal := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer cancelSignal()
-	ctx, cancelTimeout := context.WithTimeout(ctx, s.cf.KeepAlive)
-	defer cancelTimeout()
 
-	fmt.Println("Starting " + s.cf.Protocol + " server on " + s.cf.Host + ":" + s.cf.Port)
-	l, err := net.Listen(s.cf.Protocol, s.cf.Host+":"+s.cf.Port)
+	var handoffCh chan os.Signal
+	if s.cf.Handoff {
+		handoffCh = make(chan os.Signal, 1)
+		signal.Notify(handoffCh, syscall.SIGHUP, syscall.SIGUSR2)
+		defer signal.Stop(handoffCh)
+	}
+
+	var flushTick <-chan time.Time
+	if s.cf.FlushInterval > 0 {
+		ticker := time.NewTicker(s.cf.FlushInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	} else {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.cf.KeepAlive)
+		defer cancelTimeout()
+	}
+
+	err := s.limiter.validate()
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	defer l.Close()
 
-	go s.connectionsHandler(l, ctx)
+	var tlsConfig *tls.Config
+	if s.cf.TLS != nil {
+		tlsConfig, err = s.cf.TLS.build()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
 
-	select {
-	case <-ctx.Done(): // We detect context done by timeout or cancel signals from the system.
-		s.stop()
-		return ctx.Err()
-	case <-s.stopCh:  // Client send 'terminate' to disconnect all clients and perform a clean shutdown.
-		s.stop()
-		return ErrClientIndicateTerminate
+	inherited, err := inheritedListeners(len(s.listeners()), s.cf.HTTPAddr != "")
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	listeners := make([]net.Listener, 0, len(s.listeners()))
+	for i, lc := range s.listeners() {
+		fmt.Println("Starting " + lc.Network + " server on " + lc.Address)
+		var l net.Listener
+		if inherited != nil {
+			l = inherited.listeners[i]
+		} else {
+			l, err = listen(lc)
+		}
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		defer l.Close()
+		s.openListeners = append(s.openListeners, l)
+
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if s.cf.AuthTokensFile != "" {
+		s.tokens, err = auth.LoadTokens(s.cf.AuthTokensFile)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	s.audit, err = openAuditLog(s.cf.Terminate)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer s.audit.Close()
+
+	s.reportWriter, err = report.Open(s.cf.ReportFormat, s.cf.ReportPath)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer s.reportWriter.Close()
+
+	// connections (and the queue) are cancelled when the server starts draining
+	connCtx, cancelConns := context.WithCancel(ctx)
+	defer cancelConns()
+	s.cancelConns = cancelConns
+
+	if s.cf.QueueLen > 0 {
+		go s.queueHandler(connCtx)
+	}
+
+	for _, l := range listeners {
+		go s.connectionsHandler(l, connCtx)
+	}
+
+	// connections are accepted while the state is restored, skus wait for it (see waitRestored). After a handoff
+	// the previous process starts draining once this one is ready, its state is received once it finished and
+	// released its addresses.
+	if inherited != nil {
+		inherited.signalReady()
+		s.restore(inherited.snapshot)
+	} else if s.cf.SnapshotPath != "" {
+		err = s.restoreSnapshot()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	close(s.restoredCh)
+
+	var snapshotTick <-chan time.Time
+	if s.cf.SnapshotPath != "" && s.cf.SnapshotInterval > 0 {
+		ticker := time.NewTicker(s.cf.SnapshotInterval)
+		defer ticker.Stop()
+		snapshotTick = ticker.C
+	}
+
+	// addresses released before handing off to a new process (see completeHandoff)
+	var release []func()
+
+	if s.cf.MetricsAddr != "" {
+		ms, err := s.metrics.serve(s.cf.MetricsAddr)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		defer ms.Close()
+		release = append(release, func() { _ = ms.Close() })
+	}
+
+	if s.cf.AdminAddr != "" {
+		al, err := s.serveAdmin(s.cf.AdminAddr)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		defer al.Close()
+		release = append(release, func() { _ = al.Close() })
+	}
+
+	if s.cf.HTTPAddr != "" {
+		var l net.Listener
+		if inherited != nil {
+			l = inherited.http
+		} else {
+			l, err = net.Listen("tcp", s.cf.HTTPAddr)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+		}
+		s.httpListener = l
+
+		hs, err := s.serveHTTP(l)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		defer shutdownHTTP(hs)
+		s.httpServer = hs
+	}
+
+	for {
+		select {
+		case <-flushTick: // Daemon mode: close current window and keep running.
+			_, _ = s.closeWindow(ReasonWindow)
+		case <-snapshotTick: // Save the state, so the run can continue after a restart.
+			s.writeSnapshot()
+		case reply := <-s.flushCh: // Admin send 'FLUSH' to log and persist skus received until now and keep running.
+			r, err := s.flushNow()
+			reply <- flushResult{report: r, err: err}
+		case <-ctx.Done(): // We detect context done by timeout or cancel signals from the system.
+			reason := ReasonSignal
+			if ctx.Err() == context.DeadlineExceeded {
+				reason = ReasonTimeout
+			}
+			s.stop(reason)
+			return ctx.Err()
+		case <-s.stopCh: // Client send 'terminate' to disconnect all clients and perform a clean shutdown.
+			s.stop(ReasonTerminate)
+			return ErrClientIndicateTerminate
+		case <-s.shutdownCh: // Admin send 'SHUTDOWN', same as 'terminate'.
+			s.stop(ReasonShutdown)
+			return ErrAdminShutdown
+		case <-handoffCh: // Restart: a new process continue the run, this one stop without flushing.
+			err := s.handoff()
+			if err != nil {
+				log.Println("error handing off to a new process", err)
+				continue
+			}
+			err = s.completeHandoff(release)
+			if err != nil {
+				// the new process continue with an empty state, so skus of this one are flushed like in a stop
+				log.Println("error sending snapshot to the new process", err)
+				s.persist(ReasonHandoff)
+				return err
+			}
+			return ErrHandoff
+		}
 	}
 }
 
 // stop it will be called when server stop (by context=signal, timeout or message 'terminate' from client)
-// It will get report and persist that report from that execution.
-func (s *server) stop() {
+// It will drain connections and then get report and persist that report from that execution.
+func (s *server) stop(reason string) {
+	s.drain()
+	s.persist(reason)
+}
+
+// persist it will flush skus of the run (or close the window in daemon mode) once connections are drained, the
+// snapshot is removed when they are persisted
+func (s *server) persist(reason string) {
+	if s.cf.FlushInterval > 0 {
+		_, err := s.closeWindow(reason)
+		if err == nil {
+			s.removeSnapshot()
+		}
+		return
+	}
+
+	// errors of the sinks are recorded in the report, skus are kept in the snapshot for the next run
+	_, err := s.flush(s.feeder, reason, true)
+	if err != nil {
+		log.Println("error persisting skus", err)
+		s.writeSnapshot()
+		return
+	}
+	s.removeSnapshot()
+}
 
-	// Log unique SKUs
-	s.feeder.Log()
+// closeWindow it will flush skus received since the previous window and start a new one (daemon mode or FLUSH).
+// Skus of a window that could not be persisted are kept in the new one, so they are in its snapshots and persisted
+// with it.
+func (s *server) closeWindow(reason string) (service.Report, error) {
+	window := s.feeder.Rotate()
+	r, err := s.flush(window, reason, true)
+	if err != nil {
+		log.Println("error persisting window", err)
+		s.feeder.Retain(window)
+	}
+	// skus of the window are persisted (or retained), snapshot has the state of the new window
+	s.writeSnapshot()
 
-	// Print report in stdout
-	totalUnique, totalDuplicated, totalInvalid := s.feeder.Report()
+	return r, err
+}
 
-	log.Println("total number of unique product skus received for this run of the Application:", totalUnique)
-	log.Println("total number of duplicated products skus received for this run of the Application:", totalDuplicated)
-	log.Println("total number of invalid Feeder format received for this run of the Application:", totalInvalid)
+// flushNow it will persist skus received until now and keep running (FLUSH). In daemon mode it closes the window,
+// in other modes the run continues: only skus not flushed yet are written, duplicates and counters of the run are
+// kept and the report written is an interim one.
+func (s *server) flushNow() (service.Report, error) {
+	if s.cf.FlushInterval > 0 {
+		return s.closeWindow(ReasonFlush)
+	}
 
-	// Persist unique SKUs in running in storage if already were not inserted
-	totalInserted, totalSkipped, err := s.feeder.Persist()
+	r, err := s.flush(s.feeder, ReasonFlush, false)
 	if err != nil {
-		log.Panic(err)
+		log.Println("error persisting skus", err)
 	}
 
-	log.Println("total feeder persisted in storage:", totalInserted)
-	log.Println("total feeder skipped to persist in storage:", totalSkipped)
+	return r, err
 }
 
-// isLimitConnReached it will check if connCh channel is filled
-func (s *server) isLimitConnReached() bool {
-	return len(s.connCh) == cap(s.connCh)
+// flush it will write unique skus in the sinks of the feeder (log, persist...) and write the report of skus received
+// by the feeder. The report is written (and returned) even if some sink fails. Counters of the server are reset
+// when reset is true, so next report only counts what happens after it.
+func (s *server) flush(feeder service.Feeder, reason string, reset bool) (service.Report, error) {
+	endedAt := time.Now()
+
+	// Write unique SKUs in all sinks, the repository skip the ones already inserted
+	persistStart := time.Now()
+	totalInserted, totalSkipped, err := feeder.Persist()
+	s.metrics.persistDuration.Observe(time.Since(persistStart).Seconds())
+	if err != nil {
+		s.metrics.persistErrors.Inc()
+	}
+
+	// report include the result of each sink
+	r := feeder.Report()
+	r.RunID = s.runID
+	r.EndedAt = endedAt
+	r.ShutdownReason = reason
+	if reset {
+		r.Unauthenticated = int(atomic.SwapInt64(&s.unauthenticated, 0))
+		r.Timeouts = s.timeouts.swap()
+		r.Throttled = s.limiter.swap()
+	} else {
+		r.Unauthenticated = int(atomic.LoadInt64(&s.unauthenticated))
+		r.Timeouts = s.timeouts.load()
+		r.Throttled = s.limiter.load()
+	}
+	r.Inserted = totalInserted
+	r.Skipped = totalSkipped
+
+	// Print report in stdout (or file)
+	werr := s.reportWriter.Write(r)
+	if werr != nil {
+		log.Println("error writing report", werr)
+	}
+
+	return r, err
 }
 
-// connectionsHandler it will handle connections to limit number of concurrency connections
+// newRunID it will return a random identifier for the run
+func newRunID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// connectionsHandler it will handle connections of a listener to limit number of concurrency connections
 func (s *server) connectionsHandler(listener net.Listener, ctx context.Context) {
 	for {
 		conn, err := listener.Accept()
@@ -118,59 +533,369 @@ func (s *server) connectionsHandler(listener net.Listener, ctx context.Context)
 			return
 		}
 
-		if s.isLimitConnReached() {
-			log.Println("concurrent connections were reached")
-			_, err = conn.Write([]byte("limit connections reached\n"))
-			if err != nil {
-				log.Panic(err)
-			}
-
-			err = conn.Close()
-			if err != nil {
-				log.Panic(err)
-			}
-
+		// TLS handshake is done before taking a slot so clients without a valid certificate don't consume it
+		if tc, ok := conn.(*tls.Conn); ok {
+			go func() {
+				if s.handshake(tc) {
+					s.admit(conn, ctx)
+				}
+			}()
 			continue
 		}
 
-		// "increment" connection in buffered channel sending a boolean.
-		s.connCh <- true
+		s.admit(conn, ctx)
+	}
+}
+
+// admit it will handle the connection if there is a free slot, if not it will be queued (when queue is enabled)
+// or rejected. It is safe to be called concurrently.
+func (s *server) admit(conn net.Conn, ctx context.Context) {
+	if s.draining() {
+		s.reject(conn, shutdownNotice)
+		return
+	}
+
+	// when there are connections already waiting new ones go to the end of the queue to keep FIFO order
+	if s.cf.QueueLen > 0 && atomic.LoadInt32(&s.queued) > 0 {
+		s.enqueue(conn)
+		return
+	}
 
+	select {
+	case s.connCh <- true: // "increment" connection in buffered channel sending a boolean.
 		go s.requestsHandler(conn, ctx)
+	default:
+		if s.cf.QueueLen > 0 {
+			s.enqueue(conn)
+			return
+		}
+
+		log.Println("concurrent connections were reached")
+		s.reject(conn, "limit connections reached\n")
 	}
 }
 
-// requestsHandler it will handle the request from client. It will add the sku using the feeder service and
-// controle if some client send message 'terminate' to stop the application
-func (s *server) requestsHandler(conn net.Conn, ctx context.Context) {
-	buf := bufio.NewReader(conn)
+// enqueue it will put the connection at the end of the queue or reject it if the queue is full
+func (s *server) enqueue(conn net.Conn) {
 	for {
-		input, err := buf.ReadString('\n')
-		if err != nil {
-			log.Println("client disconnected", conn.RemoteAddr().String())
+		queued := atomic.LoadInt32(&s.queued)
+		if int(queued) >= s.cf.QueueLen {
+			log.Println("connections queue is full")
+			s.reject(conn, "queue full\n")
+			return
+		}
+
+		if atomic.CompareAndSwapInt32(&s.queued, queued, queued+1) {
 			break
 		}
+	}
+
+	s.queueCh <- queuedConn{conn: conn, queuedAt: time.Now()}
+}
+
+// queueHandler it will serve queued connections one by one in FIFO order until context is done
+func (s *server) queueHandler(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			s.rejectQueued()
+			return
+		case q := <-s.queueCh:
+			s.dispatch(q, ctx)
+			atomic.AddInt32(&s.queued, -1)
+		}
+	}
+}
+
+// dispatch it will wait for a free slot in connCh to handle the queued connection, or reject it when
+// the connection waited more than QueueWait
+func (s *server) dispatch(q queuedConn, ctx context.Context) {
+	var timeout <-chan time.Time
+	if s.cf.QueueWait > 0 {
+		timer := time.NewTimer(s.cf.QueueWait - time.Since(q.queuedAt))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		_ = q.conn.Close()
+		return
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+		_ = q.conn.Close()
+	case <-timeout:
+		log.Println("connection waited too long in queue", q.conn.RemoteAddr().String())
+		s.reject(q.conn, "queue wait timeout\n")
+	case s.connCh <- true:
+		go s.requestsHandler(q.conn, ctx)
+	}
+}
+
+// reject it will send the reason to the client and close the connection
+func (s *server) reject(conn net.Conn, reason string) {
+	s.metrics.rejected.Inc()
+
+	_, err := conn.Write([]byte(reason))
+	if err != nil {
+		log.Println("error writing to client", conn.RemoteAddr().String(), err)
+	}
+
+	err = conn.Close()
+	if err != nil {
+		log.Println("error closing client", conn.RemoteAddr().String(), err)
+	}
+}
+
+// Codes of the outcome of adding a sku replied to clients
+const (
+	codeAccepted  = "ACCEPTED"
+	codeDuplicate = "DUPLICATE"
+	codeInvalid   = "INVALID"
+	codeThrottled = "THROTTLED"
+)
+
+// outcomeCode it will return the code of the outcome of adding a sku and the validation error code if it is invalid
+func outcomeCode(outcome service.Outcome) (string, string) {
+	switch outcome.Status {
+	case service.Duplicated:
+		return codeDuplicate, ""
+	case service.Invalid:
+		return codeInvalid, value.ErrorCode(outcome.Reason)
+	default:
+		return codeAccepted, ""
+	}
+}
+
+// responseCode it will return the reply to the client for the outcome of adding a sku
+func responseCode(outcome service.Outcome) string {
+	code, reason := outcomeCode(outcome)
+	if reason != "" {
+		return code + " " + reason + "\n"
+	}
+
+	return code + "\n"
+}
+
+// lineKind how a line changes the connection after replying to the client
+type lineKind int
+
+const (
+	lineData      lineKind = iota // sku (or refused command), connection is closed after it in one shot mode
+	lineCommand                   // HELLO or AUTH, connection is kept open to send skus after it
+	lineTerminate                 // terminate, connection is closed
+	lineRefused                   // authentication failed, connection is closed
+)
+
+// client state of a connection
+type client struct {
+	conn          net.Conn
+	provider      string // only modified with setProvider, it is read by admin command CONNECTIONS
+	identified    bool   // provider comes from certificate or token and can't be changed with 'HELLO'
+	authenticated bool
+	identity      auth.Identity
+	bucket        *ratelimit.Bucket // nil without rate limit per connection
+	connectedAt   time.Time
+	lines         int64 // Lines received (only modified with atomic).
+	inLine        int32 // 1 while a line is being received, to give it time to finish when draining (atomic).
+	mx            sync.Mutex
+	wmx           sync.Mutex // Replies and the shutdown notice are written by different goroutines.
+}
+
+// newClient it will identify the provider of the connection by the client certificate (mutual TLS) or the address
+func (s *server) newClient(conn net.Conn) *client {
+	c := &client{
+		conn:        conn,
+		provider:    s.providers.lookup(conn.RemoteAddr()),
+		bucket:      s.limiter.connBucket(),
+		connectedAt: time.Now(),
+	}
+	if provider, ok := certificateProvider(conn); ok {
+		c.provider = provider
+		c.identified = true
+	}
+
+	return c
+}
+
+// write it will send the text to the client
+func (c *client) write(text string) error {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+
+	_, err := c.conn.Write([]byte(text))
+	return err
+}
+
+// setProvider change provider of next skus sent by the client
+func (c *client) setProvider(provider string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.provider = provider
+}
+
+// handleLine it will run the command or add the sku sent by the client and return the reply
+func (s *server) handleLine(c *client, input string) (string, lineKind) {
+	if s.tokens != nil && !c.authenticated {
+		return s.authenticate(c, input)
+	}
+
+	if secret, ok := parseTerminate(input); ok {
+		return s.terminate(c, secret)
+	}
+
+	if strings.HasPrefix(input, helloCommand) { // Client identify itself, next skus are from that provider.
+		if !c.identified {
+			c.setProvider(s.hello.name(strings.TrimSpace(strings.TrimPrefix(input, helloCommand))))
+		}
+		return "OK\n", lineCommand
+	}
+
+	if s.tokens != nil && !c.identity.Can(auth.PermSendSkus) {
+		return "FORBIDDEN\n", lineData
+	}
+
+	// only skus are throttled, so commands are not delayed or refused by rate limits
+	if s.limiter.throttle(c, s.drainCh) {
+		return codeThrottled + "\n", lineData
+	}
+
+	if !s.waitRestored() {
+		return shutdownNotice, lineRefused
+	}
+
+	outcome := s.feeder.AddSkuFrom(c.provider, input)
+	if s.cf.ResponseCodes {
+		return responseCode(outcome), lineData
+	}
+
+	return "OK\n", lineData
+}
+
+// discardLine it will count as invalid a line longer than MaxLineLength (sample is its beginning) and return the
+// reply. A line too long is never a valid command.
+func (s *server) discardLine(c *client, sample string) (string, lineKind) {
+	if s.tokens != nil && !c.authenticated {
+		return s.authenticate(c, "")
+	}
+
+	if s.limiter.throttle(c, s.drainCh) {
+		return codeThrottled + "\n", lineData
+	}
+
+	if !s.waitRestored() {
+		return shutdownNotice, lineRefused
+	}
+
+	outcome := s.feeder.Discard(c.provider, sample, value.ErrLineTooLong)
+	if s.cf.ResponseCodes {
+		return responseCode(outcome), lineData
+	}
+
+	return "OK\n", lineData
+}
+
+// authenticate it will check the first line is 'AUTH <token>' with a valid token, if not the connection is refused
+func (s *server) authenticate(c *client, input string) (string, lineKind) {
+	if strings.HasPrefix(input, authCommand) {
+		identity, ok := s.tokens.Authenticate(strings.TrimSpace(strings.TrimPrefix(input, authCommand)))
+		if ok {
+			c.authenticated = true
+			c.identity = identity
+			if !c.identified {
+				c.setProvider(identity.Provider)
+				c.identified = true
+			}
+			return "AUTH OK\n", lineCommand
+		}
+	}
 
-		input = strings.ReplaceAll(input, "\n", "")
-		input = strings.ReplaceAll(input, "\r", "")
+	s.countUnauthenticated(c)
+
+	return "AUTH FAILED\n", lineRefused
+}
+
+// countUnauthenticated it will count a client refused by authentication in the report and metrics
+func (s *server) countUnauthenticated(c *client) {
+	log.Println("client not authenticated", c.conn.RemoteAddr().String())
+	atomic.AddInt64(&s.unauthenticated, 1)
+	s.metrics.unauthenticated.Inc()
+}
+
+// requestsHandler it will handle the request from client. It will add the sku using the feeder service and
+// controle if some client send message 'terminate' to stop the application. Skus are attributed to the provider
+// of the client address or the one sent with 'HELLO <provider>'. In session mode the connection
+// is kept open until the client close it, send 'terminate', a deadline is exceeded (see readLine) or the server is
+// draining connections to stop (see drain).
+func (s *server) requestsHandler(conn net.Conn, ctx context.Context) {
+	c := s.newClient(conn)
+	s.clients.add(c)
+	defer s.clients.remove(c)
 
-		if input == "terminate" {
-			s.stopCh <- true
+	buf := s.newReader(c)
+	for !s.draining() {
+		input, err := s.readLine(c, buf)
+		if err != nil && err != errLineTooLong {
+			if s.draining() {
+				log.Println("client closed by shutdown", conn.RemoteAddr().String())
+			} else if te, ok := err.(*timeoutError); ok {
+				log.Println("client "+te.kind+" timeout", conn.RemoteAddr().String())
+				s.timeouts.inc(te.kind)
+				s.metrics.timedOut.Inc()
+			} else if err == errBudgetExceeded {
+				log.Println("client byte budget exceeded", conn.RemoteAddr().String())
+				_ = c.write("byte budget exceeded\n")
+			} else {
+				log.Println("client disconnected", conn.RemoteAddr().String())
+			}
+			// clients leaving (or timed out) before sending AUTH are not authenticated either
+			if s.tokens != nil && !c.authenticated && !s.draining() {
+				s.countUnauthenticated(c)
+			}
+			break
+		}
+		s.metrics.lines.Inc()
+		atomic.AddInt64(&c.lines, 1)
+
+		var reply string
+		var kind lineKind
+		if err == errLineTooLong {
+			reply, kind = s.discardLine(c, input)
 		} else {
-			s.feeder.AddSku(input)
+			input = strings.ReplaceAll(input, "\n", "")
+			input = strings.ReplaceAll(input, "\r", "")
+
+			reply, kind = s.handleLine(c, input)
 		}
 
-		_, err = conn.Write([]byte("OK\n"))
+		err = c.write(reply)
 		if err != nil {
-			log.Panic(err)
+			log.Println("client disconnected", conn.RemoteAddr().String(), err)
+			break
+		}
+
+		if kind == lineTerminate || kind == lineRefused {
+			break
+		}
+
+		// commands do not finish the connection in one shot mode so the client can send the sku after them
+		if s.cf.Session || kind == lineCommand {
+			continue
 		}
 
 		err = conn.Close()
 		if err != nil {
-			log.Panic(err)
+			log.Println("error closing connection", conn.RemoteAddr().String(), err)
 		}
+		break
 	}
 
+	_ = conn.Close()
+
 	// We decrement connection in buffered channel getting the boolean
 	// (release resource concurrent connections).
 	<-s.connCh
@@ -3,12 +3,19 @@ package server_test
 import (
 	"github.com/bernardosecades/feeder/pkg/server"
 	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/value"
 
 	"github.com/stretchr/testify/assert"
 
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -30,8 +37,7 @@ func TestServerDownAfterKeepAliveTime(t *testing.T) {
 
 	assert.Equal(t, context.DeadlineExceeded, err)
 
-	// we ensure when server is down call to: Log, Report and Persist from feeder service
-	assert.Equal(t, mockFeeder.CallsLog, 1)
+	// we ensure when server is down call to: Report and Persist from feeder service
 	assert.Equal(t, mockFeeder.CallsReport, 1)
 	assert.Equal(t, mockFeeder.CallsPersist, 1)
 }
@@ -62,8 +68,7 @@ func TestServerDownByClient(t *testing.T) {
 
 	assert.Equal(t, server.ErrClientIndicateTerminate, err)
 
-	// we ensure when server is down call to: Log, Report and Persist from feeder service
-	assert.Equal(t, mockFeeder.CallsLog, 1)
+	// we ensure when server is down call to: Report and Persist from feeder service
 	assert.Equal(t, mockFeeder.CallsReport, 1)
 	assert.Equal(t, mockFeeder.CallsPersist, 1)
 }
@@ -113,31 +118,657 @@ func TestServerMaxConnectionsReached(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, context.DeadlineExceeded, err)
 
-	// we ensure when server is down call to: Log, Report and Persist from feeder service
-	assert.Equal(t, mockFeeder.CallsLog, 1)
+	// we ensure when server is down call to: Report and Persist from feeder service
 	assert.Equal(t, mockFeeder.CallsReport, 1)
 	assert.Equal(t, mockFeeder.CallsPersist, 1)
 }
 
+func TestServerSessionAcceptMultipleLines(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5015")
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(conn)
+		for _, sku := range []string{"KASL-3423\n", "KASL-7770\n", "KASL-1234\n"} {
+			_, err = conn.Write([]byte(sku))
+			assert.Nil(t, err)
+
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, "OK\n", reply)
+		}
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5015",
+		KeepAlive: time.Second * 2,
+		MaxConn:   1,
+		Session:   true,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+	assert.Equal(t, 3, mockFeeder.CallsAddSku)
+}
+
+func TestServerSessionIdleTimeout(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5020")
+		assert.Nil(t, err)
+
+		// we don't send anything so server close the session after IdleTimeout
+		d := make([]byte, 120)
+		_, err = conn.Read(d)
+		assert.Equal(t, io.EOF, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:    "tcp",
+		Host:        "",
+		Port:        "5020",
+		KeepAlive:   time.Millisecond * 100,
+		MaxConn:     1,
+		Session:     true,
+		IdleTimeout: time.Millisecond * 10,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, mockFeeder.CallsAddSku)
+}
+
+func TestServerQueueWaitsForFreeSlot(t *testing.T) {
+	go func() {
+		conn1, err := dial("localhost:5025")
+		assert.Nil(t, err)
+
+		// conn2 wait in queue because conn1 is using the unique slot
+		conn2, err := dial("localhost:5025")
+		assert.Nil(t, err)
+		time.Sleep(time.Millisecond * 20)
+
+		// conn3 is rejected because conn2 is using the unique place in the queue
+		conn3, err := dial("localhost:5025")
+		assert.Nil(t, err)
+		reply, err := bufio.NewReader(conn3).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "queue full\n", reply)
+
+		// conn1 finish so conn2 is served
+		_, err = conn1.Write([]byte("KASL-3423\n"))
+		assert.Nil(t, err)
+		reply, err = bufio.NewReader(conn1).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "OK\n", reply)
+
+		_, err = conn2.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5025",
+		KeepAlive: time.Second * 2,
+		MaxConn:   1,
+		QueueLen:  1,
+		QueueWait: time.Second,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+	assert.Equal(t, 1, mockFeeder.CallsAddSku)
+}
+
+func TestServerQueueWaitTimeout(t *testing.T) {
+	go func() {
+		conn1, err := dial("localhost:5030")
+		assert.Nil(t, err)
+		assert.NotNil(t, conn1)
+
+		conn2, err := dial("localhost:5030")
+		assert.Nil(t, err)
+		reply, err := bufio.NewReader(conn2).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "queue wait timeout\n", reply)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5030",
+		KeepAlive: time.Millisecond * 200,
+		MaxConn:   1,
+		QueueLen:  1,
+		QueueWait: time.Millisecond * 10,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestServerDaemonModeFlushWindows(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5035")
+		assert.Nil(t, err)
+
+		// server keep running after KeepAlive time and close some windows
+		time.Sleep(time.Millisecond * 100)
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:      "tcp",
+		Host:          "",
+		Port:          "5035",
+		KeepAlive:     time.Millisecond * 10,
+		MaxConn:       1,
+		FlushInterval: time.Millisecond * 20,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	// each window (plus the last one when server stop) call to: Rotate, Report and Persist
+	assert.GreaterOrEqual(t, mockFeeder.CallsRotate, 3)
+	assert.Equal(t, mockFeeder.CallsRotate, mockFeeder.CallsReport)
+	assert.Equal(t, mockFeeder.CallsRotate, mockFeeder.CallsPersist)
+}
+
+func TestServerResponseCodes(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5040")
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(conn)
+		cases := []struct {
+			sku   string
+			reply string
+		}{
+			{"KASL-3423\n", "ACCEPTED\n"},
+			{"KASL-3423\n", "DUPLICATE\n"},
+			{"KASL*3423\n", "INVALID SEPARATOR\n"},
+		}
+		for _, c := range cases {
+			_, err = conn.Write([]byte(c.sku))
+			assert.Nil(t, err)
+
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, c.reply, reply)
+		}
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:      "tcp",
+		Host:          "",
+		Port:          "5040",
+		KeepAlive:     time.Second * 2,
+		MaxConn:       1,
+		Session:       true,
+		ResponseCodes: true,
+	}
+
+	seen := map[string]bool{}
+	mockFeeder := &MockFeeder{fnAddSku: func(sku string) service.Outcome {
+		if _, err := value.NewSku(sku); err != nil {
+			return service.Outcome{Status: service.Invalid, Reason: err}
+		}
+		if seen[sku] {
+			return service.Outcome{Status: service.Duplicated}
+		}
+		seen[sku] = true
+		return service.Outcome{Status: service.Accepted}
+	}}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+}
+
+func TestServerMetrics(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5045")
+		assert.Nil(t, err)
+
+		_, err = conn.Write([]byte("KASL-3423\n"))
+		assert.Nil(t, err)
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		assert.Nil(t, err)
+
+		resp, err := http.Get("http://localhost:5046/metrics")
+		assert.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+
+		assert.Contains(t, string(body), "feeder_lines_received_total 1\n")
+		assert.Contains(t, string(body), "feeder_active_connections 1\n")
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:    "tcp",
+		Host:        "",
+		Port:        "5045",
+		KeepAlive:   time.Second * 2,
+		MaxConn:     1,
+		Session:     true,
+		MetricsAddr: "localhost:5046",
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+}
+
+func TestServerWriteReport(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5050")
+		assert.Nil(t, err)
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "report.json")
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5050",
+		KeepAlive:    time.Second * 2,
+		MaxConn:      1,
+		ReportFormat: "json",
+		ReportPath:   path,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	var r service.Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.Equal(t, server.ReasonTerminate, r.ShutdownReason)
+	assert.NotEmpty(t, r.RunID)
+	assert.False(t, r.EndedAt.IsZero())
+}
+
+func TestServerSinkErrorInReport(t *testing.T) {
+	// start server
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "report.json")
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5160",
+		KeepAlive:    time.Millisecond * 10,
+		MaxConn:      1,
+		ReportFormat: "json",
+		ReportPath:   path,
+	}
+
+	mockFeeder := &MockFeeder{
+		errPersist: errors.New("sink webhook: timeout"),
+		report:     service.Report{Sinks: []service.SinkReport{{Sink: "webhook", Error: "timeout"}}},
+	}
+	srv := server.NewServer(cf, mockFeeder)
+
+	// the server stops cleanly even if a sink fails
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	var r service.Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.Equal(t, []service.SinkReport{{Sink: "webhook", Error: "timeout"}}, r.Sinks)
+}
+
+func TestServerProviders(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5055")
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(conn)
+		for _, line := range []string{"KASL-3423\n", "HELLO acme\n", "KASL-7770\n"} {
+			_, err = conn.Write([]byte(line))
+			assert.Nil(t, err)
+			_, err = buf.ReadString('\n')
+			assert.Nil(t, err)
+		}
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5055",
+		KeepAlive: time.Second * 2,
+		MaxConn:   1,
+		Session:   true,
+		Providers: map[string]string{
+			"127.0.0.0/8": "loopback",
+			"127.0.0.1":   "local",
+			"10.0.0.0/8":  "remote",
+		},
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	// first sku from provider of client address (most specific network), then the one sent with HELLO
+	assert.Equal(t, []string{"local", "acme"}, mockFeeder.Providers)
+}
+
+func TestServerProvidersLimit(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5175")
+		assert.Nil(t, err)
+		exchange(t, conn,
+			[]string{"HELLO other", "KASL-1111", "HELLO third", "KASL-2222", "HELLO acme", "KASL-3333",
+				"HELLO other", "KASL-4444", "terminate"},
+			[]string{"OK", "OK", "OK", "OK", "OK", "OK", "OK", "OK", "OK"})
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:     "tcp",
+		Host:         "",
+		Port:         "5175",
+		KeepAlive:    time.Second * 2,
+		MaxConn:      1,
+		Session:      true,
+		Providers:    map[string]string{"10.0.0.0/8": "acme"},
+		MaxProviders: 1,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	// once the limit is reached new providers are unknown, configured ones are always accepted
+	assert.Equal(t, []string{"other", "", "acme", "other"}, mockFeeder.Providers)
+}
+
+func TestServerHelloInOneShotMode(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5060")
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(conn)
+		for _, line := range []string{"HELLO acme\n", "KASL-3423\n"} {
+			_, err = conn.Write([]byte(line))
+			assert.Nil(t, err)
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, "OK\n", reply)
+		}
+
+		// connection is closed after the sku
+		_, err = buf.ReadString('\n')
+		assert.Equal(t, io.EOF, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5060",
+		KeepAlive: time.Millisecond * 200,
+		MaxConn:   1,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, []string{"acme"}, mockFeeder.Providers)
+}
+
+func TestServerAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	tokensPath := filepath.Join(dir, "tokens")
+	err := ioutil.WriteFile(tokensPath, []byte("s3cr3t acme may-send-skus\nadm1n ops may-terminate\n"), 0600)
+	assert.Nil(t, err)
+
+	go func() {
+		// client without token is refused
+		conn, err := dial("localhost:5075")
+		assert.Nil(t, err)
+		buf := bufio.NewReader(conn)
+		_, err = conn.Write([]byte("KASL-3423\n"))
+		assert.Nil(t, err)
+		reply, err := buf.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "AUTH FAILED\n", reply)
+		_, err = buf.ReadString('\n')
+		assert.Equal(t, io.EOF, err)
+
+		// client disconnected before sending AUTH is not authenticated either
+		conn, err = dial("localhost:5075")
+		assert.Nil(t, err)
+		assert.Nil(t, conn.Close())
+
+		// client can send skus (provider of the token even if it send 'HELLO') but not terminate
+		conn, err = dial("localhost:5075")
+		assert.Nil(t, err)
+		buf = bufio.NewReader(conn)
+		for _, exchange := range [][2]string{
+			{"AUTH s3cr3t\n", "AUTH OK\n"},
+			{"HELLO other\n", "OK\n"},
+			{"KASL-3423\n", "OK\n"},
+			{"terminate\n", "FORBIDDEN\n"},
+		} {
+			_, err = conn.Write([]byte(exchange[0]))
+			assert.Nil(t, err)
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, exchange[1], reply)
+		}
+		assert.Nil(t, conn.Close())
+
+		// client can terminate but not send skus
+		conn, err = dial("localhost:5075")
+		assert.Nil(t, err)
+		buf = bufio.NewReader(conn)
+		for _, exchange := range [][2]string{
+			{"AUTH adm1n\n", "AUTH OK\n"},
+			{"KASL-7770\n", "FORBIDDEN\n"},
+		} {
+			_, err = conn.Write([]byte(exchange[0]))
+			assert.Nil(t, err)
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, exchange[1], reply)
+		}
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	path := filepath.Join(dir, "report.json")
+	cf := server.Config{
+		Protocol:       "tcp",
+		Host:           "",
+		Port:           "5075",
+		KeepAlive:      time.Second * 2,
+		MaxConn:        3,
+		Session:        true,
+		ReportFormat:   "json",
+		ReportPath:     path,
+		AuthTokensFile: tokensPath,
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err = srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	assert.Equal(t, []string{"acme"}, mockFeeder.Providers)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	var r service.Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.Equal(t, 2, r.Unauthenticated)
+}
+
+// dial it will connect to the tcp server retrying while the server is starting
+func dial(address string) (net.Conn, error) {
+	return dialNetwork("tcp", address)
+}
+
+// dialNetwork it will connect to the server retrying while the server is starting
+func dialNetwork(network, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial(network, address)
+		if err == nil {
+			return conn, nil
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return nil, err
+}
+
 type MockFeeder struct {
-	CallsPersist int
-	CallsReport  int
-	CallsLog     int
+	CallsPersist  int
+	CallsReport   int
+	CallsAddSku   int
+	CallsRotate   int
+	CallsDiscard  int
+	CallsSnapshot int
+	CallsRestore  int
+	CallsRetain   int
+	Providers     []string
+	fnAddSku      func(sku string) service.Outcome
+	errPersist    error
+	report        service.Report
 }
 
 func (m *MockFeeder) Persist() (service.SkusInserted, service.SkusInsertSkipped, error) {
 	m.CallsPersist++
-	return service.SkusInserted(0), service.SkusInsertSkipped(0), nil
+	return service.SkusInserted(0), service.SkusInsertSkipped(0), m.errPersist
 }
 
-func (m *MockFeeder) Report() (service.TotalUniqueSkus, service.TotalDuplicatedSkus, service.TotalInvalidSkus) {
+func (m *MockFeeder) Report() service.Report {
 	m.CallsReport++
-	return service.TotalUniqueSkus(0), service.TotalDuplicatedSkus(0), service.TotalInvalidSkus(0)
+	return m.report
+}
+
+func (m *MockFeeder) AddSku(sku string) service.Outcome {
+	return m.AddSkuFrom("", sku)
+}
+
+func (m *MockFeeder) AddSkuFrom(provider, sku string) service.Outcome {
+	m.CallsAddSku++
+	m.Providers = append(m.Providers, provider)
+	if m.fnAddSku != nil {
+		return m.fnAddSku(sku)
+	}
+	return service.Outcome{Status: service.Accepted}
+}
+
+func (m *MockFeeder) Discard(provider, raw string, reason error) service.Outcome {
+	m.CallsDiscard++
+	m.Providers = append(m.Providers, provider)
+	return service.Outcome{Status: service.Invalid, Reason: reason}
+}
+
+func (m *MockFeeder) Rotate() service.Feeder {
+	m.CallsRotate++
+	return m
+}
+
+func (m *MockFeeder) Retain(window service.Feeder) {
+	m.CallsRetain++
+}
+
+func (m *MockFeeder) Snapshot(w io.Writer) error {
+	m.CallsSnapshot++
+	return nil
 }
 
-func (m *MockFeeder) Log() {
-	m.CallsLog++
+func (m *MockFeeder) Restore(r io.Reader) error {
+	m.CallsRestore++
+	return nil
 }
 
-func (m *MockFeeder) AddSku(sku string) {
+func (m *MockFeeder) Close() error {
+	return nil
 }
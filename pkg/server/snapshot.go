@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// restoreSnapshot it will restore the feeder from the snapshot written by a previous run that did not finish (if
+// SnapshotPath exists)
+func (s *server) restoreSnapshot() error {
+	f, err := os.Open(s.cf.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = s.feeder.Restore(f)
+	if err != nil {
+		return err
+	}
+	log.Println("state restored from snapshot", s.cf.SnapshotPath)
+
+	return nil
+}
+
+// writeSnapshot it will write the snapshot of the feeder in SnapshotPath (if enabled). It is written in a temporary
+// file renamed when it is complete, so a crash never leaves a partial snapshot. Errors are logged.
+func (s *server) writeSnapshot() {
+	if s.cf.SnapshotPath == "" {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.cf.SnapshotPath), filepath.Base(s.cf.SnapshotPath)+".*")
+	if err != nil {
+		log.Println("error writing snapshot", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	err = s.feeder.Snapshot(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.cf.SnapshotPath)
+	}
+	if err != nil {
+		log.Println("error writing snapshot", err)
+	}
+}
+
+// removeSnapshot it will remove the snapshot once the run is persisted, so next run does not restore it
+func (s *server) removeSnapshot() {
+	if s.cf.SnapshotPath == "" {
+		return
+	}
+
+	err := os.Remove(s.cf.SnapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("error removing snapshot", err)
+	}
+}
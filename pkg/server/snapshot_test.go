@@ -0,0 +1,152 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"github.com/stretchr/testify/assert"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "feeder.snapshot")
+	reportPath := filepath.Join(dir, "report.json")
+
+	// snapshot of a previous run that did not finish
+	previous := service.NewService(MockSkuRepository{}, MockLogger{})
+	previous.AddSku("KASL-3423")
+	f, err := os.Create(snapshotPath)
+	assert.Nil(t, err)
+	assert.Nil(t, previous.Snapshot(f))
+	assert.Nil(t, f.Close())
+
+	go func() {
+		conn, err := dial("localhost:5140")
+		assert.Nil(t, err)
+		exchange(t, conn, []string{"KASL-3423", "KASL-7770"}, []string{"OK", "OK"})
+
+		// snapshot written while running include skus of the previous run and the new ones
+		assert.Eventually(t, func() bool {
+			f, err := os.Open(snapshotPath)
+			if err != nil {
+				return false
+			}
+			defer f.Close()
+
+			svc := service.NewService(MockSkuRepository{}, MockLogger{})
+			return svc.Restore(f) == nil && svc.Report().Unique == 2
+		}, time.Millisecond*200, time.Millisecond*10)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:         "tcp",
+		Host:             "",
+		Port:             "5140",
+		KeepAlive:        time.Millisecond * 300,
+		MaxConn:          1,
+		Session:          true,
+		ReportFormat:     "json",
+		ReportPath:       reportPath,
+		SnapshotPath:     snapshotPath,
+		SnapshotInterval: time.Millisecond * 20,
+	}
+
+	srv := server.NewServer(cf, service.NewService(MockSkuRepository{}, MockLogger{}))
+
+	err = srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	content, err := ioutil.ReadFile(reportPath)
+	assert.Nil(t, err)
+
+	var r service.Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.EqualValues(t, 2, r.Unique)
+	assert.EqualValues(t, 1, r.Duplicated)
+
+	// run is persisted, so there is nothing to continue
+	_, err = os.Stat(snapshotPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServerSnapshotKeepSkusNotPersisted(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		port          string
+		flushInterval time.Duration
+		err           error
+	}{
+		{"keep alive", "5180", 0, context.DeadlineExceeded},
+		{"daemon", "5185", time.Millisecond * 50, server.ErrClientIndicateTerminate},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			snapshotPath := filepath.Join(t.TempDir(), "feeder.snapshot")
+
+			go func() {
+				conn, err := dial("localhost:" + c.port)
+				assert.Nil(t, err)
+				exchange(t, conn, []string{"KASL-3423"}, []string{"OK"})
+
+				// windows closed meanwhile fail to persist the sku
+				if c.flushInterval > 0 {
+					time.Sleep(c.flushInterval * 3)
+					_, err = conn.Write([]byte("terminate\n"))
+					assert.Nil(t, err)
+				}
+			}()
+
+			// start server
+			ctx := context.Background()
+			cf := server.Config{
+				Protocol:         "tcp",
+				Host:             "",
+				Port:             c.port,
+				KeepAlive:        time.Millisecond * 300,
+				MaxConn:          1,
+				Session:          true,
+				FlushInterval:    c.flushInterval,
+				SnapshotPath:     snapshotPath,
+				SnapshotInterval: time.Hour,
+			}
+
+			srv := server.NewServer(cf, service.NewService(FailingSkuRepository{}, MockLogger{}))
+
+			err := srv.Start(ctx)
+			assert.Equal(t, c.err, err)
+
+			// sku could not be persisted, so next run restores it
+			f, err := os.Open(snapshotPath)
+			assert.Nil(t, err)
+			defer f.Close()
+
+			svc := service.NewService(MockSkuRepository{}, MockLogger{})
+			assert.Nil(t, svc.Restore(f))
+			assert.EqualValues(t, 1, svc.Report().Unique)
+		})
+	}
+}
+
+// FailingSkuRepository repository always failing to persist skus
+type FailingSkuRepository struct {
+}
+
+func (m FailingSkuRepository) Persist(block map[string]value.Sku) (int64, error) {
+	return 0, errors.New("database unavailable")
+}
+
+func (m FailingSkuRepository) Delete(block map[string]value.Sku) (int64, error) {
+	return 0, nil
+}
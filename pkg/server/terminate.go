@@ -0,0 +1,215 @@
+package server
+
+import (
+	"github.com/bernardosecades/feeder/pkg/auth"
+
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// terminateCommand line sent by a client to stop the server, followed by the secret when the policy requires it
+const terminateCommand = "terminate"
+
+// Reasons why a terminate attempt is refused, written in the audit log
+const (
+	refusedDisabled   = "disabled"
+	refusedNotAllowed = "not allowed"
+	refusedSecret     = "wrong secret"
+	refusedForbidden  = "forbidden"
+)
+
+// TerminatePolicy control which clients can stop the server sending 'terminate'. Without policy any client can.
+type TerminatePolicy struct {
+	// Disabled clients can't stop the server, only signals and KeepAlive do it
+	Disabled bool
+	// Allow IPs, CIDRs or providers allowed to terminate (empty means any client). Providers only match clients
+	// identified by their certificate or token, not the ones sent with 'HELLO'.
+	Allow []string
+	// Secret confirmation the client must send as 'terminate <secret>' (empty means not required)
+	Secret string
+	// AuditPath file where every terminate attempt is appended as a json line (standard log when empty)
+	AuditPath string
+}
+
+// terminatePolicy compiled TerminatePolicy
+type terminatePolicy struct {
+	disabled  bool
+	networks  []*net.IPNet
+	providers map[string]bool
+	secret    string
+}
+
+// newTerminatePolicy parse allowed list: IPs and CIDRs are matched with the client address, anything else is a
+// provider name
+func newTerminatePolicy(cf *TerminatePolicy) *terminatePolicy {
+	p := &terminatePolicy{providers: map[string]bool{}}
+	if cf == nil {
+		return p
+	}
+
+	p.disabled = cf.Disabled
+	p.secret = cf.Secret
+	for _, allow := range cf.Allow {
+		addr := allow
+		if ip := net.ParseIP(addr); ip != nil {
+			if ip.To4() != nil {
+				addr += "/32"
+			} else {
+				addr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			p.providers[allow] = true
+			continue
+		}
+		p.networks = append(p.networks, network)
+	}
+
+	return p
+}
+
+// check return why the client can't terminate with the secret sent (empty when it can)
+func (p *terminatePolicy) check(c *client, secret string) string {
+	if p.disabled {
+		return refusedDisabled
+	}
+
+	if len(p.networks) > 0 || len(p.providers) > 0 {
+		// any client can send 'HELLO <provider>', so only providers of certificates and tokens are trusted
+		allowed := c.identified && p.providers[c.provider]
+		ip := addrIP(c.conn.RemoteAddr())
+		for _, n := range p.networks {
+			allowed = allowed || n.Contains(ip)
+		}
+		if !allowed {
+			return refusedNotAllowed
+		}
+	}
+
+	if p.secret != "" && subtle.ConstantTimeCompare([]byte(p.secret), []byte(secret)) != 1 {
+		return refusedSecret
+	}
+
+	return ""
+}
+
+// addrIP return IP of a client address (nil if it has no IP)
+func addrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// auditEntry a terminate attempt
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Address  string    `json:"address"`
+	Provider string    `json:"provider"`
+	Accepted bool      `json:"accepted"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// auditLog write terminate attempts as json lines in a file, or in the standard log when there is no file
+type auditLog struct {
+	mx  sync.Mutex
+	out io.WriteCloser
+}
+
+// openAuditLog append attempts to the audit file of the policy (standard log when there is no policy or file)
+func openAuditLog(cf *TerminatePolicy) (*auditLog, error) {
+	if cf == nil || cf.AuditPath == "" {
+		return &auditLog{}, nil
+	}
+
+	file, err := os.OpenFile(cf.AuditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{out: file}, nil
+}
+
+// write it will record an attempt of the client, refused when reason is not empty. Errors are logged.
+func (a *auditLog) write(c *client, reason string) {
+	line, err := json.Marshal(auditEntry{
+		Time:     time.Now(),
+		Address:  c.conn.RemoteAddr().String(),
+		Provider: c.provider,
+		Accepted: reason == "",
+		Reason:   reason,
+	})
+	if err != nil {
+		log.Println("error writing terminate audit", err)
+		return
+	}
+
+	if a.out == nil {
+		log.Println("terminate attempt", string(line))
+		return
+	}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	_, err = a.out.Write(append(line, '\n'))
+	if err != nil {
+		log.Println("error writing terminate audit", err)
+	}
+}
+
+// Close close the file of the audit log
+func (a *auditLog) Close() error {
+	if a.out == nil {
+		return nil
+	}
+
+	return a.out.Close()
+}
+
+// terminate it will stop the server if the client is allowed by the policy (and its token when authentication is
+// enabled). Every attempt is written in the audit log.
+func (s *server) terminate(c *client, secret string) (string, lineKind) {
+	reason := ""
+	if s.tokens != nil && !c.identity.Can(auth.PermTerminate) {
+		reason = refusedForbidden
+	} else {
+		reason = s.terminatePolicy.check(c, secret)
+	}
+
+	s.audit.write(c, reason)
+	if reason != "" {
+		return "FORBIDDEN\n", lineData
+	}
+
+	// when the server is already stopping nobody is waiting in stopCh
+	select {
+	case s.stopCh <- true:
+	case <-s.drainCh:
+	}
+	return "OK\n", lineTerminate
+}
+
+// parseTerminate return if the line is the terminate command and the secret sent with it
+func parseTerminate(input string) (string, bool) {
+	if input != terminateCommand && !strings.HasPrefix(input, terminateCommand+" ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(input, terminateCommand)), true
+}
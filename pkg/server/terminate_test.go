@@ -0,0 +1,162 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTerminatePolicy(t *testing.T) {
+	go func() {
+		for _, exchanges := range [][][2]string{
+			{
+				{"AUTH s3cr3t\n", "AUTH OK\n"},
+				{"HELLO ops\n", "OK\n"},            // provider of the token can't be changed
+				{"terminate bye\n", "FORBIDDEN\n"}, // provider not allowed
+			},
+			{
+				{"AUTH adm1n\n", "AUTH OK\n"},
+				{"terminate\n", "FORBIDDEN\n"}, // secret not sent
+				{"terminate bye\n", "OK\n"},
+			},
+		} {
+			conn, err := dial("localhost:5080")
+			assert.Nil(t, err)
+
+			buf := bufio.NewReader(conn)
+			for _, exchange := range exchanges {
+				_, err = conn.Write([]byte(exchange[0]))
+				assert.Nil(t, err)
+				reply, err := buf.ReadString('\n')
+				assert.Nil(t, err)
+				assert.Equal(t, exchange[1], reply)
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// start server
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	tokensPath := filepath.Join(dir, "tokens")
+	err := ioutil.WriteFile(tokensPath, []byte("s3cr3t acme may-send-skus,may-terminate\nadm1n ops may-terminate\n"), 0600)
+	assert.Nil(t, err)
+	cf := server.Config{
+		Protocol:       "tcp",
+		Host:           "",
+		Port:           "5080",
+		KeepAlive:      time.Second * 2,
+		MaxConn:        2,
+		Session:        true,
+		AuthTokensFile: tokensPath,
+		Terminate: &server.TerminatePolicy{
+			Allow:     []string{"10.0.0.0/8", "ops"},
+			Secret:    "bye",
+			AuditPath: path,
+		},
+	}
+
+	srv := server.NewServer(cf, &MockFeeder{})
+
+	err = srv.Start(ctx)
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 3)
+
+	expected := []struct {
+		provider string
+		accepted bool
+		reason   string
+	}{
+		{"acme", false, "not allowed"},
+		{"ops", false, "wrong secret"},
+		{"ops", true, ""},
+	}
+	for i, line := range lines {
+		var entry struct {
+			Time     time.Time `json:"time"`
+			Address  string    `json:"address"`
+			Provider string    `json:"provider"`
+			Accepted bool      `json:"accepted"`
+			Reason   string    `json:"reason"`
+		}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, expected[i].provider, entry.Provider)
+		assert.Equal(t, expected[i].accepted, entry.Accepted)
+		assert.Equal(t, expected[i].reason, entry.Reason)
+		assert.True(t, strings.HasPrefix(entry.Address, "127.0.0.1:"))
+		assert.False(t, entry.Time.IsZero())
+	}
+}
+
+func TestServerTerminateProviderSentWithHello(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5145")
+		assert.Nil(t, err)
+
+		// any client can send HELLO, so it is not allowed by provider
+		exchange(t, conn, []string{"HELLO ops", "terminate"}, []string{"OK", "FORBIDDEN"})
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5145",
+		KeepAlive: time.Millisecond * 300,
+		MaxConn:   1,
+		Session:   true,
+		Terminate: &server.TerminatePolicy{Allow: []string{"ops"}},
+	}
+
+	srv := server.NewServer(cf, &MockFeeder{})
+
+	// server is only stopped by KeepAlive
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestServerTerminateDisabled(t *testing.T) {
+	go func() {
+		conn, err := dial("localhost:5085")
+		assert.Nil(t, err)
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "FORBIDDEN\n", reply)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5085",
+		KeepAlive: time.Millisecond * 300,
+		MaxConn:   1,
+		Terminate: &server.TerminatePolicy{Disabled: true},
+	}
+
+	srv := server.NewServer(cf, &MockFeeder{})
+
+	// server is only stopped by KeepAlive
+	err := srv.Start(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+// handshakeTimeout max time to complete TLS handshake before the connection is refused
+const handshakeTimeout = time.Second * 10
+
+// All errors reported by TLS configuration
+var (
+	ErrTLSMinVersion = errors.New("unknown TLS min version, should be '1.0', '1.1', '1.2' or '1.3'")
+	ErrTLSClientCA   = errors.New("no certificates found in TLS client CA file")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig certificate and key (PEM files) of the server. With ClientCAFile clients must present a certificate
+// signed by that CA (mutual TLS) and its subject common name is the provider of the skus.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	MinVersion   string // 1.0, 1.1, 1.2 or 1.3 (1.2 by default)
+}
+
+// build it will load certificates and return configuration for the TLS listener
+func (c *TLSConfig) build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, ErrTLSMinVersion
+		}
+		minVersion = v
+	}
+
+	cf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrTLSClientCA
+		}
+
+		cf.ClientCAs = pool
+		cf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cf, nil
+}
+
+// handshake it will complete TLS handshake, if it fails (e.g.: client without a valid certificate) the
+// connection is closed
+func (s *server) handshake(conn *tls.Conn) bool {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err == nil {
+		err = conn.Handshake()
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		log.Println("TLS handshake failed", conn.RemoteAddr().String(), err)
+		s.metrics.rejected.Inc()
+		_ = conn.Close()
+		return false
+	}
+
+	return true
+}
+
+// certificateProvider it will return common name of the client certificate when connection use mutual TLS
+func certificateProvider(conn net.Conn) (string, bool) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+
+	return stateProvider(tc.ConnectionState())
+}
+
+// stateProvider return common name of the client certificate of a TLS connection (false if there is no certificate)
+func stateProvider(state tls.ConnectionState) (string, bool) {
+	certs := state.PeerCertificates
+	if len(certs) == 0 || certs[0].Subject.CommonName == "" {
+		return "", false
+	}
+
+	return certs[0].Subject.CommonName, true
+}
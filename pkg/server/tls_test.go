@@ -0,0 +1,173 @@
+package server_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/server"
+
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, dir, "ca", nil, nil)
+	newCertificate(t, dir, "server", ca, caKey)
+	client, clientKey := newCertificate(t, dir, "acme", ca, caKey)
+
+	go func() {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+
+		// client without certificate is refused and does not consume the unique slot
+		conn, err := dialTLS("localhost:5065", &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err == nil {
+			_, err = bufio.NewReader(conn).ReadString('\n')
+		}
+		assert.NotNil(t, err)
+
+		conn, err = dialTLS("localhost:5065", &tls.Config{
+			RootCAs:    roots,
+			ServerName: "localhost",
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{client.Raw},
+				PrivateKey:  clientKey,
+			}},
+		})
+		assert.Nil(t, err)
+
+		buf := bufio.NewReader(conn)
+		for _, line := range []string{"HELLO other\n", "KASL-3423\n"} {
+			_, err = conn.Write([]byte(line))
+			assert.Nil(t, err)
+			reply, err := buf.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, "OK\n", reply)
+		}
+
+		_, err = conn.Write([]byte("terminate\n"))
+		assert.Nil(t, err)
+	}()
+
+	// start server
+	ctx := context.Background()
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5065",
+		KeepAlive: time.Second * 2,
+		MaxConn:   1,
+		Session:   true,
+		TLS: &server.TLSConfig{
+			CertFile:     filepath.Join(dir, "server.pem"),
+			KeyFile:      filepath.Join(dir, "server.key"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+			MinVersion:   "1.2",
+		},
+	}
+
+	mockFeeder := &MockFeeder{}
+	srv := server.NewServer(cf, mockFeeder)
+
+	err := srv.Start(ctx)
+
+	assert.Equal(t, server.ErrClientIndicateTerminate, err)
+
+	// provider is the subject of the client certificate even if the client send 'HELLO'
+	assert.Equal(t, []string{"acme"}, mockFeeder.Providers)
+}
+
+func TestServerTLSWrongMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, dir, "ca", nil, nil)
+	newCertificate(t, dir, "server", ca, caKey)
+
+	cf := server.Config{
+		Protocol:  "tcp",
+		Host:      "",
+		Port:      "5070",
+		KeepAlive: time.Millisecond * 10,
+		MaxConn:   1,
+		TLS: &server.TLSConfig{
+			CertFile:   filepath.Join(dir, "server.pem"),
+			KeyFile:    filepath.Join(dir, "server.key"),
+			MinVersion: "0.9",
+		},
+	}
+
+	srv := server.NewServer(cf, &MockFeeder{})
+
+	assert.Equal(t, server.ErrTLSMinVersion, srv.Start(context.Background()))
+}
+
+// dialTLS it will connect to the server with TLS retrying while the server is starting
+func dialTLS(address string, cf *tls.Config) (*tls.Conn, error) {
+	conn, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := tls.Client(conn, cf)
+	err = tc.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// newCertificate it will create a certificate (and its key) signed by parent, or self-signed CA when parent is
+// nil, and write them in dir as <name>.pem and <name>.key
+func newCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	assert.Nil(t, err)
+
+	return cert, key
+}
@@ -1,11 +1,24 @@
 package service
 
 import (
+	"github.com/bernardosecades/feeder/pkg/journal"
 	"github.com/bernardosecades/feeder/pkg/logger"
 	"github.com/bernardosecades/feeder/pkg/repository"
+	"github.com/bernardosecades/feeder/pkg/sink"
 	"github.com/bernardosecades/feeder/pkg/value"
 
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type SkusInserted int
@@ -15,82 +28,765 @@ type TotalUniqueSkus int
 type TotalDuplicatedSkus int
 type TotalInvalidSkus int
 
+// Report summary of a run (or a window in daemon mode) of the application. Feeder fill counters of skus received
+// and when it started, the rest of fields are filled by the server when it finishes.
+type Report struct {
+	RunID          string              `json:"run_id"`
+	StartedAt      time.Time           `json:"started_at"`
+	EndedAt        time.Time           `json:"ended_at"`
+	Unique         TotalUniqueSkus     `json:"unique"`
+	Duplicated     TotalDuplicatedSkus `json:"duplicated"`
+	Invalid        TotalInvalidSkus    `json:"invalid"`
+	Inserted       SkusInserted        `json:"inserted"`
+	Skipped        SkusInsertSkipped   `json:"skipped"`
+	ShutdownReason string              `json:"shutdown_reason"`
+	InvalidReasons []InvalidReason     `json:"invalid_reasons"`
+	Providers      []ProviderReport    `json:"providers"`
+
+	Unauthenticated int      `json:"unauthenticated"` // Connections refused by authentication.
+	Timeouts        Timeouts `json:"timeouts"`
+	Throttled       int      `json:"throttled"` // Lines delayed or refused by rate limits.
+
+	Sinks []SinkReport `json:"sinks"` // Result of each sink when the feeder is persisted.
+}
+
+// SinkReport unique skus written in a sink (see sink.Sink), Error is empty when it succeeded
+type SinkReport struct {
+	Sink    string `json:"sink"`
+	Written int64  `json:"written"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Timeouts clients disconnected because they did not start a line (idle), did not finish it (read) or exceeded the
+// max duration of the session
+type Timeouts struct {
+	Idle    int `json:"idle"`
+	Read    int `json:"read"`
+	Session int `json:"session"`
+}
+
+// ProviderReport skus sent by a provider: unique (first provider sending a sku), duplicated and invalid
+type ProviderReport struct {
+	Provider   string              `json:"provider"`
+	Unique     TotalUniqueSkus     `json:"unique"`
+	Duplicated TotalDuplicatedSkus `json:"duplicated"`
+	Invalid    TotalInvalidSkus    `json:"invalid"`
+}
+
+// ProviderUnknown provider of skus sent by clients not identified
+const ProviderUnknown = "unknown"
+
+// InvalidReason number of invalid skus discarded by the same validation error (code from value.ErrorCode) and a
+// sample of the raw lines received
+type InvalidReason struct {
+	Code    string   `json:"code"`
+	Count   int      `json:"count"`
+	Samples []string `json:"samples"`
+}
+
+// DefaultInvalidSamples max number of raw lines kept as sample of each invalid reason
+const DefaultInvalidSamples = 5
+
+// Status what happened with a sku added to the feeder
+type Status int
+
+const (
+	Accepted Status = iota
+	Duplicated
+	Invalid
+)
+
+// Outcome result of adding a sku, Reason is the validation error (from value package) when sku is invalid
+type Outcome struct {
+	Status Status
+	Reason error
+}
+
 type Feeder interface {
 	Persist() (SkusInserted, SkusInsertSkipped, error)
-	Report() (TotalUniqueSkus, TotalDuplicatedSkus, TotalInvalidSkus)
-	Log()
-	AddSku(sku string)
+	Report() Report
+	AddSku(sku string) Outcome
+	AddSkuFrom(provider, sku string) Outcome
+	Discard(provider, raw string, reason error) Outcome
+	Rotate() Feeder
+	Retain(window Feeder)
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+	Close() error
+}
+
+// Option customize the feeder service
+type Option func(s *feeder)
+
+// WithJournal write each sku received in the journal so they are not lost if the application crash. Entries in
+// the journal not truncated by a previous execution are replayed when the service is created.
+func WithJournal(j journal.Journal) Option {
+	return func(s *feeder) {
+		s.journal = j
+	}
+}
+
+// WithSinks write unique skus in these sinks when the feeder is persisted, instead of the logger and the repository
+// given to NewService
+func WithSinks(sinks ...sink.Sink) Option {
+	return func(s *feeder) {
+		s.sinks = sinks
+	}
+}
+
+// WithStreaming write unique skus in the sinks in batches while the feeder is running (see StreamConfig), so when
+// it is persisted only the last batch is written
+func WithStreaming(cf StreamConfig) Option {
+	return func(s *feeder) {
+		s.streamConfig = &cf
+	}
+}
+
+// WithFormat validate skus with a format compiled by value.ParseFormat instead of value.DefaultFormat
+func WithFormat(f *value.Format) Option {
+	return func(s *feeder) {
+		s.format = f
+	}
+}
+
+// WithInvalidSamples set max number of raw lines kept as sample of each invalid reason
+func WithInvalidSamples(n int) Option {
+	return func(s *feeder) {
+		s.maxSamples = n
+	}
 }
 
 type feeder struct {
-	skuRepository repository.Sku
-	logger        logger.Logger
+	sinks         []sink.Sink
+	sinkReports   []SinkReport // Results of the last Persist.
+	streamConfig  *StreamConfig
+	stream        *streamer       // Nil when skus are written when the feeder is persisted.
+	streamed      *streamResult   // Skus written by the stream when the window was rotated.
+	inflight      *sync.WaitGroup // Skus accepted in the window being sent to the stream.
+	window        uint64          // Number of the current window, skus are sent to the stream with it.
+	journal       journal.Journal
+	format        *value.Format
 	skus          map[string]value.Sku
+	flushed       map[string]struct{} // Skus written in all sinks by a previous Persist, not written again.
 	invalid       int
+	invalidByCode map[string]*InvalidReason
+	maxSamples    int
 	duplicated    int
+	providers     map[string]*ProviderReport
+	startedAt     time.Time
 	mx            *sync.Mutex
 }
 
-// NewService create new instance from service.Feeder
-func NewService(skuRepository repository.Sku, logger logger.Logger) Feeder {
-	return &feeder{
-		skuRepository: skuRepository,
-		logger:        logger,
+// NewService create new instance from service.Feeder, unique skus are logged and persisted in the repository unless
+// other sinks are set with WithSinks
+func NewService(skuRepository repository.Sku, logger logger.Logger, opts ...Option) Feeder {
+	s := &feeder{
+		sinks:         []sink.Sink{sink.NewLogger(logger), sink.NewRepository(skuRepository)},
+		format:        value.DefaultFormat,
 		skus:          map[string]value.Sku{},
+		flushed:       map[string]struct{}{},
 		invalid:       0,
+		invalidByCode: map[string]*InvalidReason{},
+		maxSamples:    DefaultInvalidSamples,
 		duplicated:    0,
+		providers:     map[string]*ProviderReport{},
+		startedAt:     time.Now(),
+		inflight:      new(sync.WaitGroup),
 		mx:            new(sync.Mutex),
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.streamConfig != nil {
+		s.stream = newStreamer(*s.streamConfig, s.sinks)
+	}
+
+	if s.journal != nil {
+		err := s.journal.Replay(s.replay)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return s
+}
+
+// replay rebuild skus and counters from an entry of the journal
+func (s *feeder) replay(e journal.Entry) {
+	p := s.provider(e.Provider)
+	switch e.Op {
+	case journal.OpAccepted:
+		sk, err := value.NewSkuWithFormat(e.Sku, s.format)
+		if err == nil {
+			s.skus[sk.String()] = sk
+			p.Unique++
+			// they could be written before the crash, but there is no way to know it
+			if s.stream != nil {
+				s.stream.add(sk, s.window)
+			}
+		}
+	case journal.OpDuplicated:
+		s.duplicated++
+		p.Duplicated++
+	case journal.OpInvalid:
+		s.countInvalid(e.Reason, e.Sku)
+		p.Invalid++
+	}
+}
+
+// provider return counters of a provider (ProviderUnknown when it is empty), creating them the first time
+func (s *feeder) provider(name string) *ProviderReport {
+	if name == "" {
+		name = ProviderUnknown
+	}
+
+	p, ok := s.providers[name]
+	if !ok {
+		p = &ProviderReport{Provider: name}
+		s.providers[name] = p
+	}
+
+	return p
 }
 
-// AddSku it will add new sku only if is valid and is not duplicated in the current running application.
-// It will increment counter for invalid and duplicate sku for current running application. It is ready
-// to be safe with concurrency using lock system.
-func (s *feeder) AddSku(sku string) {
-	sk, err := value.NewSku(sku)
+// countInvalid increment counters of invalid skus and keep raw line as sample of its reason if there is room
+func (s *feeder) countInvalid(code, raw string) {
+	s.invalid++
+
+	r, ok := s.invalidByCode[code]
+	if !ok {
+		r = &InvalidReason{Code: code}
+		s.invalidByCode[code] = r
+	}
+
+	r.Count++
+	if len(r.Samples) < s.maxSamples {
+		r.Samples = append(r.Samples, raw)
+	}
+}
+
+// appendJournal write entry in the journal (if enabled), a failure is logged but the sku is not discarded
+func (s *feeder) appendJournal(e journal.Entry) {
+	if s.journal == nil {
+		return
+	}
+
+	err := s.journal.Append(e)
+	if err != nil {
+		log.Println("error writing journal", err)
+	}
+}
+
+// AddSku it will add new sku from an unknown provider, see AddSkuFrom.
+func (s *feeder) AddSku(sku string) Outcome {
+	return s.AddSkuFrom("", sku)
+}
+
+// AddSkuFrom it will add new sku only if is valid and is not duplicated in the current running application.
+// It will increment counter for invalid and duplicate sku for current running application and for the provider
+// who sent it. It is ready to be safe with concurrency using lock system. It will return if sku was accepted,
+// duplicated or invalid.
+func (s *feeder) AddSkuFrom(provider, sku string) Outcome {
+	outcome, sk, window, inflight := s.add(provider, sku)
+
+	// sent without the lock, so while the buffer of the stream is full only clients sending skus wait
+	if inflight != nil {
+		s.stream.add(sk, window)
+		inflight.Done()
+	}
+
+	return outcome
+}
+
+// add it will count the sku and return the sku to stream with its window and in-flight group when it was accepted
+// and skus are streamed (see AddSkuFrom)
+func (s *feeder) add(provider, sku string) (Outcome, value.Sku, uint64, *sync.WaitGroup) {
+	sk, err := value.NewSkuWithFormat(sku, s.format)
 
 	// we block all goroutines until the mutex is unlocked to avoid race conditions
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
+	p := s.provider(provider)
+
 	if err != nil {
-		s.invalid++
-		return
+		code := value.ErrorCode(err)
+		s.countInvalid(code, sku)
+		p.Invalid++
+		s.appendJournal(journal.Entry{Op: journal.OpInvalid, Sku: sku, Reason: code, Provider: provider})
+		return Outcome{Status: Invalid, Reason: err}, sk, s.window, nil
 	}
 
 	if _, found := s.skus[sk.String()]; found {
 		s.duplicated++
-		return
+		p.Duplicated++
+		s.appendJournal(journal.Entry{Op: journal.OpDuplicated, Sku: sk.String(), Provider: provider})
+		return Outcome{Status: Duplicated}, sk, s.window, nil
 	}
 
 	s.skus[sk.String()] = sk
-	// NOTE: we could log here (because here are uniques skus) but we use method Log called in server to improve
-	// the performance because if not, each message will access to file log to write so that is a bad performance
-	// so we log at the end.
+	p.Unique++
+	s.appendJournal(journal.Entry{Op: journal.OpAccepted, Sku: sk.String(), Provider: provider})
+	// unique skus are written in the sinks when the feeder is persisted, or in batches when they are streamed
+
+	if s.stream == nil {
+		return Outcome{Status: Accepted}, sk, s.window, nil
+	}
+
+	// the window is not written by the stream until the sku is in it
+	s.inflight.Add(1)
+	return Outcome{Status: Accepted}, sk, s.window, s.inflight
 }
 
-// Log log unique sku from running application
-func (s *feeder) Log() {
-	for _, v := range s.skus {
-		s.logger.Log("Added sku:", v.StringWithoutZeros())
+// waitInflight it will wait until skus accepted in the current window are in the stream
+func (s *feeder) waitInflight() {
+	s.mx.Lock()
+	inflight := s.inflight
+	s.mx.Unlock()
+
+	inflight.Wait()
+}
+
+// Discard it will count as invalid a line rejected before validating it as sku (e.g.: value.ErrLineTooLong), raw
+// is kept as sample of the reason.
+func (s *feeder) Discard(provider, raw string, reason error) Outcome {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	code := value.ErrorCode(reason)
+	s.countInvalid(code, raw)
+	s.provider(provider).Invalid++
+	s.appendJournal(journal.Entry{Op: journal.OpInvalid, Sku: raw, Reason: code, Provider: provider})
+
+	return Outcome{Status: Invalid, Reason: reason}
+}
+
+// Rotate it will close the current window: it returns a Feeder with the skus and counters received until now
+// and resets them, so next skus are counted in a new window. Skus received in previous windows are not
+// considered duplicated in the new one.
+func (s *feeder) Rotate() Feeder {
+	window := s.rotate()
+
+	// skus of the window are written now, without the lock so clients are not waiting for the sinks. Skus accepted
+	// meanwhile by the next window are not included.
+	if s.stream != nil {
+		window.inflight.Wait()
+		r := s.stream.rotate()
+		window.streamed = &r
 	}
+
+	return window
 }
 
-// Persist it will persist sku previously stored in memory and will return skus inserted
-// and skipped: number of skipped is because can happen a valid sku in a running application was already persisted
-// in other running application.
+// Retain it will keep unique skus of a window that could not be persisted (see Rotate) in the current one, so they
+// are persisted with it and included in its snapshots. Counters are not modified, they were reported by the window.
+func (s *feeder) Retain(window Feeder) {
+	w, ok := window.(*feeder)
+	if !ok || w == s {
+		return
+	}
+
+	w.mx.Lock()
+	skus := make(map[string]value.Sku, len(w.skus))
+	for k, sk := range w.skus {
+		skus[k] = sk
+	}
+	w.mx.Unlock()
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for k, sk := range skus {
+		s.skus[k] = sk
+	}
+}
+
+// rotate it will move skus and counters to a new window and reset them (see Rotate)
+func (s *feeder) rotate() *feeder {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	window := &feeder{
+		sinks:         s.sinks,
+		journal:       s.journal,
+		format:        s.format,
+		skus:          s.skus,
+		flushed:       s.flushed,
+		invalid:       s.invalid,
+		invalidByCode: s.invalidByCode,
+		maxSamples:    s.maxSamples,
+		duplicated:    s.duplicated,
+		providers:     s.providers,
+		startedAt:     s.startedAt,
+		inflight:      s.inflight,
+		mx:            new(sync.Mutex),
+	}
+
+	// the window keep the segment of the journal with its skus to truncate it once they are persisted
+	if s.journal != nil {
+		next, err := s.journal.Next()
+		if err != nil {
+			log.Println("error rotating journal, next skus will not be written in the journal", err)
+		}
+		s.journal = next
+	}
+
+	s.skus = map[string]value.Sku{}
+	s.flushed = map[string]struct{}{}
+	s.invalid = 0
+	s.invalidByCode = map[string]*InvalidReason{}
+	s.duplicated = 0
+	s.providers = map[string]*ProviderReport{}
+	s.startedAt = time.Now()
+	s.inflight = new(sync.WaitGroup)
+	s.window++
+
+	return window
+}
+
+// Persist it will write skus stored in memory in all sinks (even if some of them fail), or only the last batch when
+// they are streamed (see WithStreaming), and will return skus inserted and skipped by the repository sink: number
+// of skipped is because can happen a valid sku in a running application was already persisted in other running
+// application. Result of each sink is included in Report, and the error of every sink failed is returned together
+// with the skus written by the repository. It can be called again while the feeder keeps receiving skus: only skus
+// not written in all sinks by a previous call are written, counters are not modified.
 func (s *feeder) Persist() (SkusInserted, SkusInsertSkipped, error) {
-	skuInserted, err := s.skuRepository.Persist(s.skus)
+	if s.stream != nil || s.streamed != nil {
+		return s.persistStreamed()
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	pending := make(map[string]value.Sku, len(s.skus)-len(s.flushed))
+	for k, sk := range s.skus {
+		if _, found := s.flushed[k]; !found {
+			pending[k] = sk
+		}
+	}
+
+	var inserted, skipped int64
+	var errs sinkErrors
+	s.sinkReports = make([]SinkReport, 0, len(s.sinks))
+	for _, sk := range s.sinks {
+		written, err := sk.Write(pending)
+		r := SinkReport{Sink: sk.Name(), Written: written}
+		if err != nil {
+			r.Error = err.Error()
+			errs = errs.add(sk.Name(), err)
+		}
+		// skus not written by a failed repository are not skipped, they will be retried
+		if sk.Name() == sink.NameRepository {
+			inserted = written
+			if err == nil {
+				skipped = int64(len(pending)) - written
+			}
+		}
+		s.sinkReports = append(s.sinkReports, r)
+	}
+	if errs != nil {
+		return SkusInserted(inserted), SkusInsertSkipped(skipped), errs
+	}
+
+	for k := range pending {
+		s.flushed[k] = struct{}{}
+	}
+	s.truncateJournal()
+
+	return SkusInserted(inserted), SkusInsertSkipped(skipped), nil
+}
+
+// persistStreamed it will write the last batch of the stream (unless the window was already rotated) and return
+// skus written by the stream since the previous time the feeder was persisted. Skus a sink failed to write are
+// retried, and the journal is not truncated while any of them is not written.
+func (s *feeder) persistStreamed() (SkusInserted, SkusInsertSkipped, error) {
+	// the stream is written without the lock, so clients are not waiting for the sinks
+	r := s.streamed
+	if r == nil {
+		s.waitInflight()
+		result := s.stream.sync(true)
+		r = &result
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.sinkReports = r.reports
+	if r.err != nil {
+		return SkusInserted(r.inserted), SkusInsertSkipped(r.skipped), r.err
+	}
+
+	s.truncateJournal()
+
+	return SkusInserted(r.inserted), SkusInsertSkipped(r.skipped), nil
+}
+
+// truncateJournal skus are already in all sinks, so journal is not needed anymore to recover them
+func (s *feeder) truncateJournal() {
+	if s.journal == nil {
+		return
+	}
+
+	err := s.journal.Truncate()
+	if err != nil {
+		log.Println("error truncating journal", err)
+	}
+}
+
+// Report it will return summary of skus: unique, duplicated and invalid (by reason, sorted by code, and by
+// provider, sorted by name) in current running application (or window) and when it started, with results of sinks
+// once it is persisted.
+func (s *feeder) Report() Report {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	reasons := make([]InvalidReason, 0, len(s.invalidByCode))
+	for _, r := range s.invalidByCode {
+		samples := make([]string, len(r.Samples))
+		copy(samples, r.Samples)
+		reasons = append(reasons, InvalidReason{Code: r.Code, Count: r.Count, Samples: samples})
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		return reasons[i].Code < reasons[j].Code
+	})
+
+	providers := make([]ProviderReport, 0, len(s.providers))
+	for _, p := range s.providers {
+		providers = append(providers, *p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Provider < providers[j].Provider
+	})
+
+	return Report{
+		StartedAt:      s.startedAt,
+		Unique:         TotalUniqueSkus(len(s.skus)),
+		Duplicated:     TotalDuplicatedSkus(s.duplicated),
+		Invalid:        TotalInvalidSkus(s.invalid),
+		InvalidReasons: reasons,
+		Providers:      providers,
+		Sinks:          append([]SinkReport(nil), s.sinkReports...),
+	}
+}
+
+// SnapshotVersion version of the format written by Snapshot, Restore refuses other versions
+const SnapshotVersion = 1
+
+// sinkErrors errors of the sinks failed when the feeder is persisted, it wraps the first one
+type sinkErrors []error
+
+// add it will return the errors with the one of the sink
+func (e sinkErrors) add(name string, err error) sinkErrors {
+	return append(e, fmt.Errorf("sink %s: %w", name, err))
+}
+
+func (e sinkErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+func (e sinkErrors) Unwrap() error {
+	return e[0]
+}
+
+// All errors reported by Restore
+var (
+	ErrSnapshotVersion  = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum does not match its state")
+)
+
+// snapshot json written by Snapshot: the state with the version of the format and its sha256 checksum (hex)
+type snapshot struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
+}
+
+// state skus and counters of a feeder written by Snapshot
+type state struct {
+	StartedAt      time.Time        `json:"started_at"`
+	Skus           []string         `json:"skus"`
+	Duplicated     int              `json:"duplicated"`
+	Invalid        int              `json:"invalid"`
+	InvalidReasons []InvalidReason  `json:"invalid_reasons"`
+	Providers      []ProviderReport `json:"providers"`
+}
+
+// checksum return sha256 (hex) of the state, ignoring spaces so a snapshot formatted to inspect it is still valid
+func checksum(st json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	err := json.Compact(&buf, st)
 	if err != nil {
-		return 0, 0, err
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Snapshot it will write skus and counters of the feeder as json (see SnapshotVersion), so the run can continue
+// in another process or after a restart with Restore
+func (s *feeder) Snapshot(w io.Writer) error {
+	// skus are written before the snapshot (without the lock), so the process restoring it does not need to write
+	// them again
+	if s.stream != nil {
+		s.waitInflight()
+		s.stream.sync(false)
 	}
-	skipped := int64(len(s.skus)) - skuInserted
 
-	return SkusInserted(skuInserted), SkusInsertSkipped(skipped), nil
+	s.mx.Lock()
+	st := state{
+		StartedAt:  s.startedAt,
+		Skus:       make([]string, 0, len(s.skus)),
+		Duplicated: s.duplicated,
+		Invalid:    s.invalid,
+	}
+	for k := range s.skus {
+		st.Skus = append(st.Skus, k)
+	}
+	for _, r := range s.invalidByCode {
+		st.InvalidReasons = append(st.InvalidReasons, *r)
+	}
+	for _, p := range s.providers {
+		st.Providers = append(st.Providers, *p)
+	}
+	s.mx.Unlock()
+
+	// sorted so the same state always produce the same snapshot
+	sort.Strings(st.Skus)
+	sort.Slice(st.InvalidReasons, func(i, j int) bool {
+		return st.InvalidReasons[i].Code < st.InvalidReasons[j].Code
+	})
+	sort.Slice(st.Providers, func(i, j int) bool {
+		return st.Providers[i].Provider < st.Providers[j].Provider
+	})
+
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	sum, err := checksum(raw)
+	if err != nil {
+		return err
+	}
 
+	return json.NewEncoder(w).Encode(snapshot{Version: SnapshotVersion, Checksum: sum, State: raw})
 }
 
-// Report it will return summary of skus: unique, duplicated and invalid in current running application.
-func (s *feeder) Report() (TotalUniqueSkus, TotalDuplicatedSkus, TotalInvalidSkus) {
-	return TotalUniqueSkus(len(s.skus)), TotalDuplicatedSkus(s.duplicated), TotalInvalidSkus(s.invalid)
+// Restore it will replace skus and counters of the feeder with the ones written by Snapshot, after checking its
+// version and checksum. Skus are validated again with the format of the feeder. With a journal they are merged with
+// the state replayed from it instead (see merge).
+func (s *feeder) Restore(r io.Reader) error {
+	var snap snapshot
+	err := json.NewDecoder(r).Decode(&snap)
+	if err != nil {
+		return err
+	}
+
+	if snap.Version != SnapshotVersion {
+		return ErrSnapshotVersion
+	}
+	sum, err := checksum(snap.State)
+	if err != nil {
+		return err
+	}
+	if sum != snap.Checksum {
+		return ErrSnapshotChecksum
+	}
+
+	var st state
+	err = json.Unmarshal(snap.State, &st)
+	if err != nil {
+		return err
+	}
+
+	skus := make(map[string]value.Sku, len(st.Skus))
+	for _, raw := range st.Skus {
+		sk, err := value.NewSkuWithFormat(raw, s.format)
+		if err != nil {
+			return err
+		}
+		skus[sk.String()] = sk
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.journal != nil {
+		s.merge(st, skus)
+		return nil
+	}
+
+	s.startedAt = st.StartedAt
+	s.skus = skus
+	s.flushed = map[string]struct{}{}
+	s.duplicated = st.Duplicated
+	s.invalid = st.Invalid
+	s.invalidByCode = map[string]*InvalidReason{}
+	for i := range st.InvalidReasons {
+		s.invalidByCode[st.InvalidReasons[i].Code] = &st.InvalidReasons[i]
+	}
+	s.providers = map[string]*ProviderReport{}
+	for i := range st.Providers {
+		s.providers[st.Providers[i].Provider] = &st.Providers[i]
+	}
+
+	return nil
+}
+
+// merge it will add the state of a snapshot to the state replayed from the journal. Both record the same run since
+// it was persisted, one of them until a later moment, so skus are joined and the greater of each counter is kept:
+// skus accepted after the snapshot (only in the journal) or before it (only in the snapshot of a handoff) are not
+// lost.
+func (s *feeder) merge(st state, skus map[string]value.Sku) {
+	if st.StartedAt.Before(s.startedAt) {
+		s.startedAt = st.StartedAt
+	}
+	for k, sk := range skus {
+		s.skus[k] = sk
+	}
+	s.duplicated = maxInt(s.duplicated, st.Duplicated)
+	s.invalid = maxInt(s.invalid, st.Invalid)
+
+	for i := range st.InvalidReasons {
+		r := st.InvalidReasons[i]
+		current, ok := s.invalidByCode[r.Code]
+		if !ok || r.Count > current.Count {
+			s.invalidByCode[r.Code] = &r
+		}
+	}
+
+	for i := range st.Providers {
+		p := st.Providers[i]
+		current := s.provider(p.Provider)
+		current.Unique = TotalUniqueSkus(maxInt(int(current.Unique), int(p.Unique)))
+		current.Duplicated = TotalDuplicatedSkus(maxInt(int(current.Duplicated), int(p.Duplicated)))
+		current.Invalid = TotalInvalidSkus(maxInt(int(current.Invalid), int(p.Invalid)))
+	}
+}
+
+// maxInt return the greater of two numbers
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// Close it will stop writing skus in background (see WithStreaming) once skus waiting are written, it returns the
+// error of sinks that could not write some of them. Without streaming there is nothing to close.
+func (s *feeder) Close() error {
+	if s.stream == nil {
+		return nil
+	}
+
+	s.waitInflight()
+	return s.stream.close()
 }
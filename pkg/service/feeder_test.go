@@ -1,13 +1,20 @@
 package service_test
 
 import (
+	"github.com/bernardosecades/feeder/pkg/journal"
 	"github.com/bernardosecades/feeder/pkg/service"
+	"github.com/bernardosecades/feeder/pkg/sink"
 	"github.com/bernardosecades/feeder/pkg/value"
 
 	"github.com/stretchr/testify/assert"
 
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestServiceReportWithoutConcurrency(t *testing.T) {
@@ -20,11 +27,81 @@ func TestServiceReportWithoutConcurrency(t *testing.T) {
 	svc.AddSku("KASL-1234") // duplicated
 	svc.AddSku("765-1234")  // invalid
 
-	totalUnique, totalDuplicated, totalInvalid := svc.Report()
+	report := svc.Report()
 
-	assert.EqualValues(t, 3, totalUnique)
-	assert.EqualValues(t, 1, totalDuplicated)
-	assert.EqualValues(t, 1, totalInvalid)
+	assert.EqualValues(t, 3, report.Unique)
+	assert.EqualValues(t, 1, report.Duplicated)
+	assert.EqualValues(t, 1, report.Invalid)
+}
+
+func TestServiceAddSkuOutcome(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+
+	assert.Equal(t, service.Outcome{Status: service.Accepted}, svc.AddSku("KASL-3423"))
+	assert.Equal(t, service.Outcome{Status: service.Duplicated}, svc.AddSku("kasl-3423"))
+	assert.Equal(t, service.Outcome{Status: service.Invalid, Reason: value.ErrLenFirstPartSku}, svc.AddSku("765-1234"))
+}
+
+func TestServiceAddSkuWithFormat(t *testing.T) {
+	f, err := value.ParseFormat("letters{2} '-' digits{6}")
+	assert.Nil(t, err)
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{}, service.WithFormat(f))
+
+	svc.AddSku("AB-123456") // valid
+	svc.AddSku("ab-123456") // duplicated
+	svc.AddSku("KASL-3423") // invalid with this format
+
+	report := svc.Report()
+	assert.EqualValues(t, 1, report.Unique)
+	assert.EqualValues(t, 1, report.Duplicated)
+	assert.EqualValues(t, 1, report.Invalid)
+}
+
+func TestServiceReportInvalidReasons(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{}, service.WithInvalidSamples(2))
+
+	svc.AddSku("765-1234")   // invalid LEN_FIRST_PART
+	svc.AddSku("76-1234")    // invalid LEN_FIRST_PART
+	svc.AddSku("76543-1234") // invalid LEN_FIRST_PART
+	svc.AddSku("KASL*1234")  // invalid SEPARATOR
+	svc.AddSku("KASL-1234")  // valid
+
+	report := svc.Report()
+	assert.EqualValues(t, 4, report.Invalid)
+	assert.Equal(t, []service.InvalidReason{
+		{Code: "LEN_FIRST_PART", Count: 3, Samples: []string{"765-1234", "76-1234"}},
+		{Code: "SEPARATOR", Count: 1, Samples: []string{"KASL*1234"}},
+	}, report.InvalidReasons)
+}
+
+func TestServiceDiscard(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+
+	outcome := svc.Discard("acme", "KASL-34234234", value.ErrLineTooLong)
+	assert.Equal(t, service.Outcome{Status: service.Invalid, Reason: value.ErrLineTooLong}, outcome)
+
+	report := svc.Report()
+	assert.EqualValues(t, 1, report.Invalid)
+	assert.Equal(t, []service.InvalidReason{
+		{Code: "LINE_TOO_LONG", Count: 1, Samples: []string{"KASL-34234234"}},
+	}, report.InvalidReasons)
+	assert.Equal(t, []service.ProviderReport{{Provider: "acme", Invalid: 1}}, report.Providers)
+}
+
+func TestServiceReportProviders(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+
+	svc.AddSkuFrom("acme", "KASL-3423")  // valid
+	svc.AddSkuFrom("other", "KASL-3423") // duplicated
+	svc.AddSkuFrom("other", "765-1234")  // invalid
+	svc.AddSku("KASL-7770")              // valid from unknown provider
+
+	report := svc.Report()
+	assert.Equal(t, []service.ProviderReport{
+		{Provider: "acme", Unique: 1, Duplicated: 0, Invalid: 0},
+		{Provider: "other", Unique: 0, Duplicated: 1, Invalid: 1},
+		{Provider: service.ProviderUnknown, Unique: 1, Duplicated: 0, Invalid: 0},
+	}, report.Providers)
 }
 
 func TestServiceReportRunSafelyConcurrently(t *testing.T) {
@@ -43,13 +120,13 @@ func TestServiceReportRunSafelyConcurrently(t *testing.T) {
 	}
 	wg.Wait()
 
-	totalUnique, totalDuplicated, totalInvalid := svc.Report()
+	report := svc.Report()
 
-	assert.EqualValues(t, 1, totalUnique)
-	assert.EqualValues(t, numberRoutines, totalInvalid)
+	assert.EqualValues(t, 1, report.Unique)
+	assert.EqualValues(t, numberRoutines, report.Invalid)
 	// we put 1 to give context -> 1 = "KASL-1234" is the unique valid so will
 	// duplicate the valid minus the first time we add (is not duplicated)
-	assert.EqualValues(t, (numberRoutines * 1) - 1, totalDuplicated)
+	assert.EqualValues(t, (numberRoutines * 1) - 1, report.Duplicated)
 }
 
 func TestServicePersistWhenStorageAlreadyContainOneSkuAddedInThisRunning(t *testing.T) {
@@ -88,6 +165,404 @@ func TestServicePersistWhenStorageDontContainAnySkuAddedInThisRunning(t *testing
 	assert.EqualValues(t, 0, totalSkipped)
 }
 
+func TestServicePersistOnlySkusNotPersistedYet(t *testing.T) {
+	var blocks []int
+	mock := &MockSkuRepository{fnPersist: func(block map[string]value.Sku) (int64, error) {
+		blocks = append(blocks, len(block))
+		return int64(len(block)), nil
+	}}
+	svc := service.NewService(mock, MockLoggerSvc{})
+
+	svc.AddSku("KASL-3423")
+	totalInserted, _, err := svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, totalInserted)
+
+	// the run continue: skus persisted are still duplicated and counted
+	svc.AddSku("KASL-3423")
+	svc.AddSku("KASL-7770")
+	totalInserted, _, err = svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, totalInserted)
+	assert.Equal(t, []int{1, 1}, blocks)
+
+	report := svc.Report()
+	assert.EqualValues(t, 2, report.Unique)
+	assert.EqualValues(t, 1, report.Duplicated)
+}
+
+func TestServiceRotateResetWindow(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+
+	svc.AddSku("KASL-3423") // valid
+	svc.AddSku("KASL-3423") // duplicated
+	svc.AddSku("765-1234")  // invalid
+
+	window := svc.Rotate()
+
+	svc.AddSku("KASL-3423") // valid in the new window
+	svc.AddSku("KASL-7770") // valid
+
+	report := window.Report()
+	assert.EqualValues(t, 1, report.Unique)
+	assert.EqualValues(t, 1, report.Duplicated)
+	assert.EqualValues(t, 1, report.Invalid)
+
+	report = svc.Report()
+	assert.EqualValues(t, 2, report.Unique)
+	assert.EqualValues(t, 0, report.Duplicated)
+	assert.EqualValues(t, 0, report.Invalid)
+}
+
+func TestServiceRetainWindowNotPersisted(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+
+	svc.AddSku("KASL-3423") // valid
+	svc.AddSku("KASL-3423") // duplicated
+
+	window := svc.Rotate()
+	svc.AddSku("KASL-7770") // valid in the new window
+	svc.Retain(window)
+
+	// skus of the window are kept, counters were reported by the window
+	report := svc.Report()
+	assert.EqualValues(t, 2, report.Unique)
+	assert.EqualValues(t, 0, report.Duplicated)
+	assert.Equal(t, service.Outcome{Status: service.Duplicated}, svc.AddSku("KASL-3423"))
+}
+
+func TestServiceReplayJournalAndTruncateAfterPersist(t *testing.T) {
+	cf := journal.Config{Dir: t.TempDir(), Sync: journal.SyncAlways}
+
+	j, err := journal.Open(cf)
+	assert.Nil(t, err)
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{}, service.WithJournal(j))
+
+	svc.AddSku("KASL-3423") // valid
+	svc.AddSku("KASL-3423") // duplicated
+	svc.AddSku("765-1234")  // invalid
+
+	// application crash without persist, next execution rebuild skus and counters
+	j, err = journal.Open(cf)
+	assert.Nil(t, err)
+	svc = service.NewService(MockSkuRepository{}, MockLoggerSvc{}, service.WithJournal(j))
+
+	report := svc.Report()
+	assert.EqualValues(t, 1, report.Unique)
+	assert.EqualValues(t, 1, report.Duplicated)
+	assert.EqualValues(t, 1, report.Invalid)
+	assert.Equal(t, []service.InvalidReason{{Code: "LEN_FIRST_PART", Count: 1, Samples: []string{"765-1234"}}},
+		report.InvalidReasons)
+
+	_, _, err = svc.Persist()
+	assert.Nil(t, err)
+
+	// after persist there is nothing to replay
+	j, err = journal.Open(cf)
+	assert.Nil(t, err)
+	svc = service.NewService(MockSkuRepository{}, MockLoggerSvc{}, service.WithJournal(j))
+
+	report = svc.Report()
+	assert.EqualValues(t, 0, report.Unique)
+	assert.EqualValues(t, 0, report.Duplicated)
+	assert.EqualValues(t, 0, report.Invalid)
+}
+
+func TestServiceSnapshotRestore(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+	svc.AddSkuFrom("acme", "KASL-3423") // valid
+	svc.AddSkuFrom("acme", "KASL-3423") // duplicated
+	svc.AddSku("765-1234")              // invalid
+
+	var buf bytes.Buffer
+	assert.Nil(t, svc.Snapshot(&buf))
+
+	restored := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+	restored.AddSku("KASL-7770") // replaced by the snapshot
+	assert.Nil(t, restored.Restore(&buf))
+
+	expected, actual := svc.Report(), restored.Report()
+	assert.True(t, expected.StartedAt.Equal(actual.StartedAt))
+	expected.StartedAt, actual.StartedAt = time.Time{}, time.Time{}
+	assert.Equal(t, expected, actual)
+
+	// skus restored are duplicated in the new process
+	assert.Equal(t, service.Outcome{Status: service.Duplicated}, restored.AddSku("KASL-3423"))
+}
+
+func TestServiceRestoreRefuseInvalidSnapshot(t *testing.T) {
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+	svc.AddSku("KASL-3423")
+
+	var buf bytes.Buffer
+	assert.Nil(t, svc.Snapshot(&buf))
+	valid := buf.String()
+
+	restored := service.NewService(MockSkuRepository{}, MockLoggerSvc{})
+	tampered := strings.Replace(valid, "KASL-3423", "KASL-7770", 1)
+	assert.Equal(t, service.ErrSnapshotChecksum, restored.Restore(strings.NewReader(tampered)))
+	future := strings.Replace(valid, `"version":1`, `"version":2`, 1)
+	assert.Equal(t, service.ErrSnapshotVersion, restored.Restore(strings.NewReader(future)))
+
+	// state is not modified when the snapshot is refused
+	assert.EqualValues(t, 0, restored.Report().Unique)
+}
+
+func TestServicePersistFanOutToSinks(t *testing.T) {
+	repository := MockSkuRepository{fnPersist: func(block map[string]value.Sku) (int64, error) {
+		return 1, nil
+	}}
+	failing := &MockSink{name: "webhook", err: errors.New("timeout")}
+	full := &MockSink{name: "csv", err: errors.New("disk full")}
+	stdout := &MockSink{name: "stdout"}
+	svc := service.NewService(nil, nil, service.WithSinks(sink.NewRepository(repository), failing, full, stdout))
+
+	svc.AddSku("KASL-3423")
+	svc.AddSku("KASL-7770")
+
+	// all sinks are written even if some of them fail, skus written by the repository are returned with the errors
+	totalInserted, totalSkipped, err := svc.Persist()
+	assert.EqualError(t, err, "sink webhook: timeout; sink csv: disk full")
+	assert.True(t, errors.Is(err, failing.err))
+	assert.EqualValues(t, 1, totalInserted)
+	assert.EqualValues(t, 1, totalSkipped)
+	assert.Equal(t, 2, stdout.written)
+	assert.Equal(t, []service.SinkReport{
+		{Sink: "repository", Written: 1},
+		{Sink: "webhook", Error: "timeout"},
+		{Sink: "csv", Error: "disk full"},
+		{Sink: "stdout", Written: 2},
+	}, svc.Report().Sinks)
+
+	failing.err = nil
+	full.err = nil
+	totalInserted, totalSkipped, err = svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, totalInserted)
+	assert.EqualValues(t, 1, totalSkipped)
+}
+
+func TestServiceStreamingBatches(t *testing.T) {
+	stream := &MockSink{name: "repository"}
+	svc := service.NewService(nil, nil, service.WithSinks(stream),
+		service.WithStreaming(service.StreamConfig{BatchSize: 2, Interval: time.Millisecond * 50, Buffer: 10}))
+
+	// full batch is written right away
+	svc.AddSku("KASL-3423")
+	svc.AddSku("KASL-7770")
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual([]int{2}, stream.Batches())
+	}, time.Second, time.Millisecond*5)
+
+	// the rest when interval finish
+	svc.AddSku("KASL-1111")
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual([]int{2, 1}, stream.Batches())
+	}, time.Second, time.Millisecond*5)
+
+	// persist only write the tail
+	svc.AddSku("KASL-2222")
+	totalInserted, totalSkipped, err := svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4, totalInserted)
+	assert.EqualValues(t, 0, totalSkipped)
+	assert.Equal(t, []int{2, 1, 1}, stream.Batches())
+	assert.Equal(t, []service.SinkReport{{Sink: "repository", Written: 4}}, svc.Report().Sinks)
+}
+
+func TestServiceStreamingRotate(t *testing.T) {
+	stream := &MockSink{name: "repository"}
+	svc := service.NewService(nil, nil, service.WithSinks(stream),
+		service.WithStreaming(service.StreamConfig{BatchSize: 100, Interval: time.Hour, Buffer: 10}))
+
+	svc.AddSku("KASL-3423")
+	window := svc.Rotate()
+	svc.AddSku("KASL-7770")
+
+	// skus of the window were written when it was rotated
+	totalInserted, _, err := window.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, totalInserted)
+
+	totalInserted, _, err = svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, totalInserted)
+	assert.Equal(t, []int{1, 1}, stream.Batches())
+}
+
+func TestServiceStreamingRotateWhileWriting(t *testing.T) {
+	release := make(chan bool)
+	stream := &MockSink{name: "repository", wait: release}
+	svc := service.NewService(nil, nil, service.WithSinks(stream),
+		service.WithStreaming(service.StreamConfig{BatchSize: 1, Interval: time.Hour, Buffer: 10}))
+
+	svc.AddSku("KASL-3423") // being written
+
+	rotated := make(chan service.Feeder)
+	go func() {
+		rotated <- svc.Rotate()
+	}()
+	assert.Eventually(t, func() bool {
+		return svc.Report().Unique == 0
+	}, time.Second, time.Millisecond*5)
+
+	// accepted by the new window while the stream is still writing the previous one
+	svc.AddSku("KASL-7770")
+	close(release)
+	window := <-rotated
+
+	totalInserted, _, err := window.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, totalInserted)
+
+	totalInserted, _, err = svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, totalInserted)
+	assert.Nil(t, svc.Close())
+}
+
+func TestServiceStreamingBackpressure(t *testing.T) {
+	release := make(chan bool)
+	stream := &MockSink{name: "repository", wait: release}
+	svc := service.NewService(nil, nil, service.WithSinks(stream),
+		service.WithStreaming(service.StreamConfig{BatchSize: 1, Interval: time.Hour, Buffer: 1}))
+
+	svc.AddSku("KASL-1111") // being written
+	svc.AddSku("KASL-2222") // in the buffer
+
+	added := make(chan bool)
+	go func() {
+		svc.AddSku("KASL-3333") // buffer is full
+		added <- true
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("sku added while the buffer is full")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// only the client sending the new sku waits, the feeder is not locked
+	assert.Equal(t, service.Outcome{Status: service.Duplicated}, svc.AddSku("KASL-1111"))
+	assert.EqualValues(t, 3, svc.Report().Unique)
+
+	close(release)
+	<-added
+	_, _, err := svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, svc.Report().Sinks[0].Written)
+	assert.Nil(t, svc.Close())
+}
+
+func TestServiceStreamingRetryFailedBatches(t *testing.T) {
+	repository := &MockSink{name: "repository"}
+	stream := &MockSink{name: "webhook", err: errors.New("timeout")}
+	svc := service.NewService(nil, nil, service.WithSinks(repository, stream),
+		service.WithStreaming(service.StreamConfig{BatchSize: 1, Interval: time.Hour, Buffer: 10}))
+
+	svc.AddSku("KASL-1111")
+
+	// batch is kept while the sink fails, skus written by the repository are returned with the error
+	totalInserted, _, err := svc.Persist()
+	assert.EqualError(t, err, "sink webhook: timeout")
+	assert.EqualValues(t, 1, totalInserted)
+	totalInserted, _, err = svc.Persist()
+	assert.EqualError(t, err, "sink webhook: timeout")
+	assert.EqualValues(t, 0, totalInserted)
+	assert.Equal(t, []service.SinkReport{{Sink: "repository"}, {Sink: "webhook", Error: "timeout"}}, svc.Report().Sinks)
+
+	stream.SetErr(nil)
+	svc.AddSku("KASL-2222")
+	_, _, err = svc.Persist()
+	assert.Nil(t, err)
+	assert.Equal(t, []service.SinkReport{{Sink: "repository", Written: 1}, {Sink: "webhook", Written: 2}},
+		svc.Report().Sinks)
+	assert.Equal(t, []int{2}, stream.Batches())
+
+	// skus waiting are written when it is closed
+	stream.SetErr(errors.New("timeout"))
+	svc.AddSku("KASL-3333")
+	assert.EqualError(t, svc.Close(), "sink webhook: timeout")
+}
+
+func TestServiceRestoreSnapshotWithJournal(t *testing.T) {
+	cf := journal.Config{Dir: t.TempDir(), Sync: journal.SyncAlways}
+
+	j, err := journal.Open(cf)
+	assert.Nil(t, err)
+	svc := service.NewService(MockSkuRepository{}, MockLoggerSvc{}, service.WithJournal(j))
+
+	svc.AddSku("KASL-3423")
+	var snapshot bytes.Buffer
+	assert.Nil(t, svc.Snapshot(&snapshot))
+	svc.AddSku("KASL-7770") // only in the journal
+	svc.AddSku("KASL-7770") // duplicated
+
+	// application crash, next execution replay the journal and restore the older snapshot
+	j, err = journal.Open(cf)
+	assert.Nil(t, err)
+	var persisted map[string]value.Sku
+	repository := MockSkuRepository{fnPersist: func(block map[string]value.Sku) (int64, error) {
+		persisted = block
+		return int64(len(block)), nil
+	}}
+	svc = service.NewService(repository, MockLoggerSvc{}, service.WithJournal(j))
+	assert.Nil(t, svc.Restore(&snapshot))
+
+	report := svc.Report()
+	assert.EqualValues(t, 2, report.Unique)
+	assert.EqualValues(t, 1, report.Duplicated)
+	assert.Equal(t, []service.ProviderReport{{Provider: "unknown", Unique: 2, Duplicated: 1}}, report.Providers)
+
+	totalInserted, _, err := svc.Persist()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, totalInserted)
+	assert.Len(t, persisted, 2)
+}
+
+type MockSink struct {
+	name    string
+	err     error
+	wait    chan bool
+	written int
+	batches []int
+	mx      sync.Mutex
+}
+
+func (m *MockSink) Name() string {
+	return m.name
+}
+
+func (m *MockSink) Write(block map[string]value.Sku) (int64, error) {
+	if m.wait != nil {
+		<-m.wait
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.err != nil {
+		return 0, m.err
+	}
+	m.written += len(block)
+	m.batches = append(m.batches, len(block))
+	return int64(len(block)), nil
+}
+
+func (m *MockSink) SetErr(err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.err = err
+}
+
+func (m *MockSink) Batches() []int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return append([]int(nil), m.batches...)
+}
+
 type MockSkuRepository struct {
 	fnPersist func(block map[string]value.Sku) (int64, error)
 	fnDelete func(block map[string]value.Sku) (int64, error)
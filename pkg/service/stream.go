@@ -0,0 +1,261 @@
+package service
+
+import (
+	"github.com/bernardosecades/feeder/pkg/sink"
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"log"
+	"time"
+)
+
+// StreamConfig write unique skus in the sinks while the feeder is running, in batches of BatchSize skus or every
+// Interval (what happens first), so persisting the feeder only has to write the last batch
+type StreamConfig struct {
+	// BatchSize max skus written in each batch
+	BatchSize int
+	// Interval max time a sku waits to be written, batches that failed are retried with the same interval
+	Interval time.Duration
+	// Buffer skus waiting to be written, when it is full new skus wait for it (backpressure to clients)
+	Buffer int
+}
+
+// streamResult skus written by the streamer since the previous result was taken, err is the error of the sinks with
+// skus still not written
+type streamResult struct {
+	inserted int64
+	skipped  int64
+	reports  []SinkReport
+	err      error
+}
+
+// syncRequest ask the streamer to write skus waiting in the buffer, and to return the result when take is true.
+// When rotate is true the result is taken and next skus written are the ones of the next window.
+type syncRequest struct {
+	take   bool
+	rotate bool
+	reply  chan streamResult
+}
+
+// streamSku sku queued in the stream with the window that accepted it
+type streamSku struct {
+	sku    value.Sku
+	window uint64
+}
+
+// streamer it will write skus in sinks from a background goroutine. Skus a sink failed to write are kept and
+// written again with the next batch.
+type streamer struct {
+	cf        StreamConfig
+	sinks     []sink.Sink
+	skus      chan streamSku
+	syncCh    chan syncRequest
+	doneCh    chan struct{} // Closed to stop the goroutine.
+	stoppedCh chan struct{} // Closed when the goroutine finished.
+
+	// Only modified by the goroutine (or once it finished).
+	pending []map[string]value.Sku // Skus not written yet in each sink.
+	errs    []error                // Last error of each sink while it has skus pending.
+	result  streamResult
+	window  uint64               // Window of the skus written, skus of the next one wait until it is rotated.
+	next    map[string]value.Sku // Skus of the next window queued before the current one was rotated.
+}
+
+// newStreamer create a streamer and start its goroutine, it runs until it is closed
+func newStreamer(cf StreamConfig, sinks []sink.Sink) *streamer {
+	if cf.BatchSize <= 0 {
+		cf.BatchSize = 1
+	}
+	if cf.Interval <= 0 {
+		cf.Interval = time.Second
+	}
+
+	st := &streamer{
+		cf:        cf,
+		sinks:     sinks,
+		skus:      make(chan streamSku, cf.Buffer),
+		syncCh:    make(chan syncRequest),
+		doneCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+		pending:   make([]map[string]value.Sku, len(sinks)),
+		errs:      make([]error, len(sinks)),
+		next:      map[string]value.Sku{},
+	}
+	for i := range st.pending {
+		st.pending[i] = map[string]value.Sku{}
+	}
+	st.reset()
+	go st.run()
+
+	return st
+}
+
+// add it will queue the sku accepted by the window to be written, blocking while the buffer is full (the sku is
+// dropped if the streamer was closed)
+func (st *streamer) add(sk value.Sku, window uint64) {
+	select {
+	case st.skus <- streamSku{sku: sk, window: window}:
+	case <-st.doneCh:
+		log.Println("sku added after closing the stream", sk.String())
+	}
+}
+
+// sync it will write skus queued until now and wait for them. When take is true it return the result of skus
+// written since the previous time it was taken.
+func (st *streamer) sync(take bool) streamResult {
+	return st.request(syncRequest{take: take})
+}
+
+// rotate it will write skus of the current window queued until now and return the result of skus written since the
+// previous time it was taken, then skus of the next window are written. Skus of the next window queued before are
+// not included in the result.
+func (st *streamer) rotate() streamResult {
+	return st.request(syncRequest{take: true, rotate: true})
+}
+
+// request it will send the request to the goroutine and wait for its reply
+func (st *streamer) request(req syncRequest) streamResult {
+	take := req.take
+	req.reply = make(chan streamResult, 1)
+	select {
+	case st.syncCh <- req:
+		return <-req.reply
+	case <-st.stoppedCh:
+		if take {
+			return st.take()
+		}
+		return streamResult{}
+	}
+}
+
+// close it will write skus queued and stop the goroutine, it returns the error of sinks with skus not written
+func (st *streamer) close() error {
+	close(st.doneCh)
+	<-st.stoppedCh
+
+	return st.take().err
+}
+
+// run write a batch when it is full, when the interval finish or when it is requested by sync or close
+func (st *streamer) run() {
+	defer close(st.stoppedCh)
+
+	ticker := time.NewTicker(st.cf.Interval)
+	defer ticker.Stop()
+
+	batch := map[string]value.Sku{}
+	for {
+		select {
+		case sk := <-st.skus:
+			if !st.queue(batch, sk) {
+				continue
+			}
+			if len(batch) >= st.cf.BatchSize {
+				st.write(batch)
+				batch = map[string]value.Sku{}
+			}
+		case <-ticker.C:
+			st.write(batch)
+			batch = map[string]value.Sku{}
+		case req := <-st.syncCh:
+			st.write(st.drain(batch))
+			batch = map[string]value.Sku{}
+
+			r := streamResult{}
+			if req.take {
+				r = st.take()
+			}
+			if req.rotate {
+				st.window++
+				batch, st.next = st.next, map[string]value.Sku{}
+			}
+			req.reply <- r
+		case <-st.doneCh:
+			batch = st.drain(batch)
+			for k, v := range st.next {
+				batch[k] = v
+			}
+			st.write(batch)
+			return
+		}
+	}
+}
+
+// queue add the sku to the batch and return true, unless it belongs to the next window: then it waits in next
+// until the current window is rotated
+func (st *streamer) queue(batch map[string]value.Sku, sk streamSku) bool {
+	if sk.window != st.window {
+		st.next[sk.sku.String()] = sk.sku
+		return false
+	}
+
+	batch[sk.sku.String()] = sk.sku
+	return true
+}
+
+// drain add to the batch skus waiting in the buffer
+func (st *streamer) drain(batch map[string]value.Sku) map[string]value.Sku {
+	for {
+		select {
+		case sk := <-st.skus:
+			st.queue(batch, sk)
+		default:
+			return batch
+		}
+	}
+}
+
+// write it will write the batch, plus the skus pending from previous batches, in all sinks and add what was written
+// to the result. Skus are kept pending in the sinks that failed.
+func (st *streamer) write(batch map[string]value.Sku) {
+	for i, sk := range st.sinks {
+		pending := st.pending[i]
+		for k, v := range batch {
+			pending[k] = v
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		written, err := sk.Write(pending)
+		if err != nil {
+			log.Println("error writing sink", sk.Name(), err, len(pending), "skus will be retried")
+			st.errs[i] = err
+			continue
+		}
+
+		st.result.reports[i].Written += written
+		if sk.Name() == sink.NameRepository {
+			st.result.inserted += written
+			st.result.skipped += int64(len(pending)) - written
+		}
+		st.pending[i] = map[string]value.Sku{}
+		st.errs[i] = nil
+	}
+}
+
+// take it will return the result and start a new one, sinks with skus pending are reported as failed
+func (st *streamer) take() streamResult {
+	r := st.result
+	var errs sinkErrors
+	for i, err := range st.errs {
+		if err == nil {
+			continue
+		}
+		r.reports[i].Error = err.Error()
+		errs = errs.add(st.sinks[i].Name(), err)
+	}
+	if errs != nil {
+		r.err = errs
+	}
+	st.reset()
+
+	return r
+}
+
+// reset it will start a new result
+func (st *streamer) reset() {
+	st.result = streamResult{reports: make([]SinkReport, 0, len(st.sinks))}
+	for _, sk := range st.sinks {
+		st.result.reports = append(st.result.reports, SinkReport{Sink: sk.Name()})
+	}
+}
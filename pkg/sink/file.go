@@ -0,0 +1,101 @@
+package sink
+
+import (
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"encoding/csv"
+	"encoding/json"
+	"os"
+)
+
+type jsonLinesSink struct {
+	path string
+}
+
+// NewJSONLines create a sink appending skus to a file as json objects, one per line
+func NewJSONLines(path string) Sink {
+	return &jsonLinesSink{path: path}
+}
+
+func (s *jsonLinesSink) Name() string {
+	return NameJSONLines
+}
+
+// Write append skus, e.g.: {"sku":"KASL-3423"}
+func (s *jsonLinesSink) Write(skus map[string]value.Sku) (int64, error) {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var written int64
+	enc := json.NewEncoder(file)
+	for _, sk := range sorted(skus) {
+		err = enc.Encode(struct {
+			Sku string `json:"sku"`
+		}{Sku: sk.String()})
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, file.Close()
+}
+
+type csvSink struct {
+	path string
+}
+
+// NewCSV create a sink appending skus to a csv file, header is only written when the file is empty
+func NewCSV(path string) Sink {
+	return &csvSink{path: path}
+}
+
+func (s *csvSink) Name() string {
+	return NameCSV
+}
+
+// Write append skus as rows of csv, each row is flushed so skus written before an error are counted
+func (s *csvSink) Write(skus map[string]value.Sku) (int64, error) {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	out := csv.NewWriter(file)
+	if info.Size() == 0 {
+		err = out.Write([]string{"sku"})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var written int64
+	for _, sk := range sorted(skus) {
+		err = out.Write([]string{sk.String()})
+		if err == nil {
+			out.Flush()
+			err = out.Error()
+		}
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	out.Flush()
+	err = out.Error()
+	if err != nil {
+		return written, err
+	}
+
+	return written, file.Close()
+}
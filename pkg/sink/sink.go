@@ -0,0 +1,186 @@
+package sink
+
+import (
+	"github.com/bernardosecades/feeder/pkg/logger"
+	"github.com/bernardosecades/feeder/pkg/repository"
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the built-in sinks, used to configure them (see New) and in reports
+const (
+	NameLogger     = "logger"
+	NameRepository = "repository"
+	NameJSONLines  = "jsonl"
+	NameCSV        = "csv"
+	NameStdout     = "stdout"
+	NameWebhook    = "webhook"
+)
+
+// All errors reported by the package
+var (
+	ErrUnknownSink   = errors.New("unknown sink, should be 'logger', 'repository', 'jsonl', 'csv', 'stdout' or 'webhook'")
+	ErrMissingConfig = errors.New("sink is not configured")
+)
+
+// Sink destination of unique skus of a run (or a window in daemon mode), they are written when the feeder is
+// persisted
+type Sink interface {
+	// Name identify the sink in reports
+	Name() string
+	// Write it will send skus and return how many of them were written (e.g.: repository skips the ones already
+	// persisted), on error the ones written before it
+	Write(skus map[string]value.Sku) (int64, error)
+}
+
+// Config dependencies and destinations of the built-in sinks, only the ones of the sinks created are required
+type Config struct {
+	Logger           logger.Logger
+	Repository       repository.Sku
+	JSONLinesPath    string
+	CSVPath          string
+	Stdout           io.Writer
+	WebhookURL       string
+	WebhookTimeout   time.Duration
+	WebhookBatchSize int
+}
+
+// New create built-in sinks by name, in the same order
+func New(names []string, cf Config) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(names))
+	for _, name := range names {
+		s, err := newSink(strings.TrimSpace(name), cf)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+
+	return sinks, nil
+}
+
+func newSink(name string, cf Config) (Sink, error) {
+	missing := fmt.Errorf("%w: %s", ErrMissingConfig, name)
+
+	switch name {
+	case NameLogger:
+		if cf.Logger == nil {
+			return nil, missing
+		}
+		return NewLogger(cf.Logger), nil
+	case NameRepository:
+		if cf.Repository == nil {
+			return nil, missing
+		}
+		return NewRepository(cf.Repository), nil
+	case NameJSONLines:
+		if cf.JSONLinesPath == "" {
+			return nil, missing
+		}
+		return NewJSONLines(cf.JSONLinesPath), nil
+	case NameCSV:
+		if cf.CSVPath == "" {
+			return nil, missing
+		}
+		return NewCSV(cf.CSVPath), nil
+	case NameStdout:
+		if cf.Stdout == nil {
+			return nil, missing
+		}
+		return NewWriter(NameStdout, cf.Stdout), nil
+	case NameWebhook:
+		if cf.WebhookURL == "" {
+			return nil, missing
+		}
+		return NewWebhook(cf.WebhookURL, cf.WebhookTimeout, cf.WebhookBatchSize), nil
+	}
+
+	return nil, ErrUnknownSink
+}
+
+// sorted return skus sorted, so sinks always write them in the same order
+func sorted(skus map[string]value.Sku) []value.Sku {
+	list := make([]value.Sku, 0, len(skus))
+	for _, sk := range skus {
+		list = append(list, sk)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].String() < list[j].String()
+	})
+
+	return list
+}
+
+type loggerSink struct {
+	logger logger.Logger
+}
+
+// NewLogger create a sink logging each sku (without zeros on the left of digit parts)
+func NewLogger(l logger.Logger) Sink {
+	return &loggerSink{logger: l}
+}
+
+func (s *loggerSink) Name() string {
+	return NameLogger
+}
+
+// Write log skus, e.g.: Added sku: KASL-3423
+func (s *loggerSink) Write(skus map[string]value.Sku) (int64, error) {
+	for _, sk := range sorted(skus) {
+		s.logger.Log("Added sku:", sk.StringWithoutZeros())
+	}
+
+	return int64(len(skus)), nil
+}
+
+type repositorySink struct {
+	repository repository.Sku
+}
+
+// NewRepository create a sink persisting skus in the repository
+func NewRepository(r repository.Sku) Sink {
+	return &repositorySink{repository: r}
+}
+
+func (s *repositorySink) Name() string {
+	return NameRepository
+}
+
+// Write persist skus, skus already persisted are skipped and not counted as written
+func (s *repositorySink) Write(skus map[string]value.Sku) (int64, error) {
+	return s.repository.Persist(skus)
+}
+
+type writerSink struct {
+	name string
+	out  io.Writer
+}
+
+// NewWriter create a sink printing one sku per line in out (e.g.: os.Stdout)
+func NewWriter(name string, out io.Writer) Sink {
+	return &writerSink{name: name, out: out}
+}
+
+func (s *writerSink) Name() string {
+	return s.name
+}
+
+// Write print skus one per line
+func (s *writerSink) Write(skus map[string]value.Sku) (int64, error) {
+	var written int64
+	for _, sk := range sorted(skus) {
+		_, err := fmt.Fprintln(s.out, sk.String())
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
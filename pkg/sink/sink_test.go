@@ -0,0 +1,129 @@
+package sink_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/sink"
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func skus(t *testing.T, values ...string) map[string]value.Sku {
+	block := map[string]value.Sku{}
+	for _, v := range values {
+		sk, err := value.NewSku(v)
+		assert.Nil(t, err)
+		block[sk.String()] = sk
+	}
+
+	return block
+}
+
+func TestNewByName(t *testing.T) {
+	var buf bytes.Buffer
+	sinks, err := sink.New([]string{"stdout", " jsonl"}, sink.Config{Stdout: &buf, JSONLinesPath: "skus.jsonl"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sinks))
+	assert.Equal(t, sink.NameStdout, sinks[0].Name())
+	assert.Equal(t, sink.NameJSONLines, sinks[1].Name())
+
+	_, err = sink.New([]string{"kafka"}, sink.Config{})
+	assert.Equal(t, sink.ErrUnknownSink, err)
+
+	_, err = sink.New([]string{"webhook"}, sink.Config{})
+	assert.True(t, errors.Is(err, sink.ErrMissingConfig))
+}
+
+func TestLoggerAndWriter(t *testing.T) {
+	l := &MockLogger{}
+	written, err := sink.NewLogger(l).Write(skus(t, "KASL-0023"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, written)
+	assert.Equal(t, [][]interface{}{{"Added sku:", "KASL-23"}}, l.lines)
+
+	var buf bytes.Buffer
+	written, err = sink.NewWriter(sink.NameStdout, &buf).Write(skus(t, "KASL-7770", "KASL-3423"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, written)
+	assert.Equal(t, "KASL-3423\nKASL-7770\n", buf.String())
+}
+
+func TestFilesAppend(t *testing.T) {
+	dir := t.TempDir()
+	jsonl := sink.NewJSONLines(filepath.Join(dir, "skus.jsonl"))
+	csv := sink.NewCSV(filepath.Join(dir, "skus.csv"))
+
+	for _, v := range []string{"KASL-3423", "KASL-7770"} {
+		for _, s := range []sink.Sink{jsonl, csv} {
+			written, err := s.Write(skus(t, v))
+			assert.Nil(t, err)
+			assert.EqualValues(t, 1, written)
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "skus.jsonl"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"sku\":\"KASL-3423\"}\n{\"sku\":\"KASL-7770\"}\n", string(content))
+
+	// header is only written when file is empty
+	content, err = ioutil.ReadFile(filepath.Join(dir, "skus.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "sku\nKASL-3423\nKASL-7770\n", string(content))
+}
+
+func TestWebhook(t *testing.T) {
+	var received []string
+	requests := 0
+	failAt := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		requests++
+		if requests == failAt {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var body struct {
+			Skus []string `json:"skus"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		received = append(received, body.Skus...)
+	}))
+	defer ts.Close()
+
+	// skus are sent in batches of 2
+	webhook := sink.NewWebhook(ts.URL, 0, 2)
+	written, err := webhook.Write(skus(t, "KASL-7770", "KASL-3423", "KASL-1111"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, written)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, []string{"KASL-1111", "KASL-3423", "KASL-7770"}, received)
+
+	// nothing is sent without skus
+	written, err = webhook.Write(skus(t))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, written)
+	assert.Equal(t, 2, requests)
+
+	// skus of the batches sent before the failure are written
+	requests, failAt = 0, 2
+	written, err = webhook.Write(skus(t, "KASL-1111", "KASL-2222", "KASL-3333"))
+	assert.EqualError(t, err, "webhook replied with status 500")
+	assert.EqualValues(t, 2, written)
+	assert.Equal(t, 2, requests)
+}
+
+type MockLogger struct {
+	lines [][]interface{}
+}
+
+func (m *MockLogger) Log(v ...interface{}) {
+	m.lines = append(m.lines, v)
+}
@@ -0,0 +1,92 @@
+package sink
+
+import (
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultWebhookTimeout time waiting for the webhook to reply when the config does not set it
+const DefaultWebhookTimeout = time.Second * 10
+
+// DefaultWebhookBatchSize max skus sent in each request when the config does not set it
+const DefaultWebhookBatchSize = 1000
+
+// webhookRequest body sent to the webhook
+type webhookRequest struct {
+	Skus []string `json:"skus"`
+}
+
+type webhookSink struct {
+	url       string
+	batchSize int
+	client    *http.Client
+}
+
+// NewWebhook create a sink sending skus to the url with POST requests of batchSize skus at most, any status but
+// 2xx is an error
+func NewWebhook(url string, timeout time.Duration, batchSize int) Sink {
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultWebhookBatchSize
+	}
+
+	return &webhookSink{url: url, batchSize: batchSize, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *webhookSink) Name() string {
+	return NameWebhook
+}
+
+// Write post skus as json in batches, e.g.: {"skus":["KASL-3423","KASL-7770"]}. Nothing is sent when there are no
+// skus, and it stops at the first batch failed.
+func (s *webhookSink) Write(skus map[string]value.Sku) (int64, error) {
+	var written int64
+	list := sorted(skus)
+	for len(list) > 0 {
+		n := s.batchSize
+		if n > len(list) {
+			n = len(list)
+		}
+
+		err := s.post(list[:n])
+		if err != nil {
+			return written, err
+		}
+		written += int64(n)
+		list = list[n:]
+	}
+
+	return written, nil
+}
+
+// post it will send one batch of skus
+func (s *webhookSink) post(skus []value.Sku) error {
+	req := webhookRequest{Skus: make([]string, 0, len(skus))}
+	for _, sk := range skus {
+		req.Skus = append(req.Skus, sk.String())
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook replied with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -17,3 +17,14 @@ func IsUnsignedInteger(text string) bool {
 
 	return true
 }
+
+// IsOnlyDigits check if a string content only digits from 0 to 9 (without sign and of any length)
+func IsOnlyDigits(text string) bool {
+	for _, d := range text {
+		if d < '0' || d > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -16,3 +16,13 @@ func TestIsAllNumbers(t *testing.T) {
 	assert.False(t, numberfn.IsUnsignedInteger("1.5"))
 	assert.False(t, numberfn.IsUnsignedInteger("-123"))
 }
+
+func TestIsOnlyDigits(t *testing.T) {
+	assert.True(t, numberfn.IsOnlyDigits("123"))
+	assert.True(t, numberfn.IsOnlyDigits("000123"))
+	assert.True(t, numberfn.IsOnlyDigits("12345678901234567890123"))
+
+	assert.False(t, numberfn.IsOnlyDigits("00A123"))
+	assert.False(t, numberfn.IsOnlyDigits("+123"))
+	assert.False(t, numberfn.IsOnlyDigits("-123"))
+}
@@ -0,0 +1,242 @@
+package value
+
+import (
+	"github.com/bernardosecades/feeder/pkg/tools/numberfn"
+	"github.com/bernardosecades/feeder/pkg/tools/stringfn"
+
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Errors reported by skus validated with a format parsed by ParseFormat, they are wrapped with the number of the part
+var (
+	ErrLenPartSku     = errors.New("part of sku has wrong length")
+	ErrLettersPartSku = errors.New("part of sku only can content letters")
+	ErrDigitsPartSku  = errors.New("part of sku only can content digits")
+	ErrAlnumPartSku   = errors.New("part of sku only can content letters and digits")
+)
+
+// Errors reported by ParseFormat
+var (
+	ErrFormatSyntax     = errors.New("wrong sku format syntax")
+	ErrFormatAdjacent   = errors.New("sku format parts should be separated by a literal")
+	ErrFormatNoLiterals = errors.New("sku format should have at least one literal")
+)
+
+// class of characters allowed in a part of sku
+type class string
+
+const (
+	letters class = "letters"
+	digits  class = "digits"
+	alnum   class = "alnum"
+)
+
+// part of sku between literals (separators), a zero length part (min and max 0) must be empty
+type part struct {
+	class    class
+	min      int
+	max      int
+	unsigned bool // digits are validated as an unsigned integer (e.g.: +123 is valid), like the original format
+	errLen   error
+	errClass error
+}
+
+// Format compiled specification of the sku grammar: parts of characters (letters, digits or alnum) with their
+// length, separated by literals. Use ParseFormat to compile it from text like: letters{4} '-' digits{4}
+type Format struct {
+	spec     string
+	literals []string
+	parts    []part // always len(literals)+1
+}
+
+// DefaultFormat four letters, a dash and four digits (e.g.: KASL-3423). It reports errors of the original format and,
+// like it, accepts the second part as an unsigned integer with sign (e.g.: KASL-+123).
+var DefaultFormat = &Format{
+	spec:     "letters{4} '-' digits{4}",
+	literals: []string{separator},
+	parts: []part{
+		{class: letters, min: 4, max: 4, errLen: ErrLenFirstPartSku, errClass: ErrLettersFirstPartSku},
+		{class: digits, min: 4, max: 4, unsigned: true, errLen: ErrLenSecondPartSku, errClass: ErrNumberSecondPartSku},
+	},
+}
+
+// ParseFormat compile a format specification: a list of parts separated by spaces, where a part is a class of
+// characters (letters, digits or alnum) with its length ({n} or {min,max}) and literals are quoted with ', e.g:
+// letters{2} '-' digits{6} or letters{4} '-' digits{4} '-' letters{2}
+func ParseFormat(spec string) (*Format, error) {
+	f := &Format{spec: spec, parts: []part{{}}}
+
+	rest := strings.TrimSpace(spec)
+	for rest != "" {
+		if strings.HasPrefix(rest, "'") {
+			end := strings.Index(rest[1:], "'")
+			if end <= 0 {
+				return nil, fmt.Errorf("%w: literal not closed or empty in %q", ErrFormatSyntax, rest)
+			}
+			f.literals = append(f.literals, rest[1:end+1])
+			f.parts = append(f.parts, part{})
+			rest = strings.TrimSpace(rest[end+2:])
+			continue
+		}
+
+		end := strings.Index(rest, "}")
+		if end < 0 {
+			return nil, fmt.Errorf("%w: length not closed in %q", ErrFormatSyntax, rest)
+		}
+		p, err := parsePart(rest[:end+1])
+		if err != nil {
+			return nil, err
+		}
+
+		n := len(f.parts)
+		if f.parts[n-1].class != "" {
+			return nil, ErrFormatAdjacent
+		}
+		p.errLen = fmt.Errorf("part %d: %w", n, ErrLenPartSku)
+		p.errClass = fmt.Errorf("part %d: %w", n, classErrors[p.class])
+		f.parts[n-1] = p
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+
+	if len(f.literals) == 0 {
+		return nil, ErrFormatNoLiterals
+	}
+
+	return f, nil
+}
+
+var classErrors = map[class]error{
+	letters: ErrLettersPartSku,
+	digits:  ErrDigitsPartSku,
+	alnum:   ErrAlnumPartSku,
+}
+
+// parsePart compile a part like digits{4} or digits{4,6}
+func parsePart(text string) (part, error) {
+	open := strings.Index(text, "{")
+	if open < 0 {
+		return part{}, fmt.Errorf("%w: length not found in %q", ErrFormatSyntax, text)
+	}
+
+	c := class(strings.TrimSpace(text[:open]))
+	if _, ok := classErrors[c]; !ok {
+		return part{}, fmt.Errorf("%w: unknown class %q, should be letters, digits or alnum", ErrFormatSyntax, c)
+	}
+
+	bounds := strings.Split(text[open+1:len(text)-1], ",")
+	if len(bounds) > 2 {
+		return part{}, fmt.Errorf("%w: wrong length in %q", ErrFormatSyntax, text)
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil || min <= 0 {
+		return part{}, fmt.Errorf("%w: wrong length in %q", ErrFormatSyntax, text)
+	}
+
+	max := min
+	if len(bounds) == 2 {
+		max, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil || max < min {
+			return part{}, fmt.Errorf("%w: wrong length in %q", ErrFormatSyntax, text)
+		}
+	}
+
+	return part{class: c, min: min, max: max}, nil
+}
+
+// String return specification of the format
+func (f *Format) String() string {
+	return f.spec
+}
+
+// split value in parts by literals, it will return ErrSeparatorSku if literals are not found in the right order
+// or some part content a literal
+func (f *Format) split(v string) ([]string, error) {
+	parts := make([]string, 0, len(f.parts))
+	rest := v
+	for _, l := range f.literals {
+		i := strings.Index(rest, l)
+		if i < 0 {
+			return nil, ErrSeparatorSku
+		}
+		parts = append(parts, rest[:i])
+		rest = rest[i+len(l):]
+	}
+	parts = append(parts, rest)
+
+	for _, p := range parts {
+		for _, l := range f.literals {
+			if strings.Contains(p, l) {
+				return nil, ErrSeparatorSku
+			}
+		}
+	}
+
+	return parts, nil
+}
+
+// validateAndNormalize it will validate value and return it normalized (letters in upper case)
+func (f *Format) validateAndNormalize(v string) (string, error) {
+	parts, err := f.split(v)
+	if err != nil {
+		return "", err
+	}
+
+	for i, p := range f.parts {
+		if p.class == "" && parts[i] != "" {
+			return "", ErrSeparatorSku
+		}
+		if p.class != "" && (len(parts[i]) < p.min || len(parts[i]) > p.max) {
+			return "", p.errLen
+		}
+	}
+
+	for i, p := range f.parts {
+		if !p.valid(parts[i]) {
+			return "", p.errClass
+		}
+		if p.class == letters || p.class == alnum {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+
+	return f.join(parts), nil
+}
+
+// join parts with literals
+func (f *Format) join(parts []string) string {
+	var b strings.Builder
+	for i, p := range parts {
+		if i > 0 {
+			b.WriteString(f.literals[i-1])
+		}
+		b.WriteString(p)
+	}
+
+	return b.String()
+}
+
+// valid check if text only content characters of the class of the part
+func (p part) valid(text string) bool {
+	switch p.class {
+	case letters:
+		return stringfn.IsOnlyLetters(text)
+	case digits:
+		if p.unsigned {
+			return numberfn.IsUnsignedInteger(text)
+		}
+		return numberfn.IsOnlyDigits(text)
+	case alnum:
+		for _, r := range text {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,105 @@
+package value_test
+
+import (
+	"github.com/bernardosecades/feeder/pkg/value"
+
+	"github.com/stretchr/testify/assert"
+
+	"errors"
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	cases := []struct {
+		spec string
+		err  error
+	}{
+		{"letters{4} '-' digits{4}", nil},
+		{"letters{2} '-' digits{6}", nil},
+		{"letters{4} '-' digits{4} '-' letters{2}", nil},
+		{"alnum{2,5} '/' digits{1,3}", nil},
+		{"'#' digits{4}", nil},
+		{"letters{4}", value.ErrFormatNoLiterals},
+		{"letters{4} digits{4}", value.ErrFormatAdjacent},
+		{"words{4} '-' digits{4}", value.ErrFormatSyntax},
+		{"letters{0} '-' digits{4}", value.ErrFormatSyntax},
+		{"letters{4,2} '-' digits{4}", value.ErrFormatSyntax},
+		{"letters{4 '-' digits{4}", value.ErrFormatSyntax},
+		{"letters{4} '- digits{4}", value.ErrFormatSyntax},
+	}
+
+	for _, c := range cases {
+		f, err := value.ParseFormat(c.spec)
+		if c.err == nil {
+			assert.Nil(t, err, c.spec)
+			assert.Equal(t, c.spec, f.String())
+		} else {
+			assert.True(t, errors.Is(err, c.err), c.spec)
+		}
+	}
+}
+
+func TestValidSkuWithFormat(t *testing.T) {
+	cases := []struct {
+		spec        string
+		skuInput    string
+		skuExpected string
+	}{
+		{"letters{2} '-' digits{6}", "ab-123456", "AB-123456"},
+		{"letters{4} '-' digits{4} '-' letters{2}", " wxyz-1234-eu\n", "WXYZ-1234-EU"},
+		{"alnum{2,5} '/' digits{1,3}", "a1b/7", "A1B/7"},
+		{"'#' digits{4}", "#0042", "#0042"},
+	}
+
+	for _, c := range cases {
+		f, err := value.ParseFormat(c.spec)
+		assert.Nil(t, err)
+
+		sku, err := value.NewSkuWithFormat(c.skuInput, f)
+		assert.Nil(t, err)
+		assert.Equal(t, c.skuExpected, sku.String())
+	}
+}
+
+func TestInvalidSkuWithFormat(t *testing.T) {
+	f, err := value.ParseFormat("letters{4} '-' digits{4} '-' letters{2}")
+	assert.Nil(t, err)
+
+	cases := []struct {
+		skuInput string
+		err      error
+		code     string
+	}{
+		{"WXYZ-1234", value.ErrSeparatorSku, "SEPARATOR"},
+		{"WXYZ-1234-EU-ES", value.ErrSeparatorSku, "SEPARATOR"},
+		{"WXYZ-1234-E", value.ErrLenPartSku, "LEN_PART"},
+		{"WXYZ-1234-E1", value.ErrLettersPartSku, "LETTERS_PART"},
+		{"WXYZ-12A4-EU", value.ErrDigitsPartSku, "DIGITS_PART"},
+	}
+
+	for _, c := range cases {
+		_, err := value.NewSkuWithFormat(c.skuInput, f)
+		assert.True(t, errors.Is(err, c.err), c.skuInput)
+		assert.Equal(t, c.code, value.ErrorCode(err))
+	}
+}
+
+func TestDigitsOfParsedFormatWithoutSign(t *testing.T) {
+	f, err := value.ParseFormat("letters{4} '-' digits{4}")
+	assert.Nil(t, err)
+
+	// the default format keeps accepting a sign like the original one, digits of a parsed format do not
+	_, err = value.NewSku("KASL-+123")
+	assert.Nil(t, err)
+	_, err = value.NewSkuWithFormat("KASL-+123", f)
+	assert.True(t, errors.Is(err, value.ErrDigitsPartSku))
+}
+
+func TestSkuWithoutZerosWithFormat(t *testing.T) {
+	f, err := value.ParseFormat("letters{4} '-' digits{4} '-' digits{2}")
+	assert.Nil(t, err)
+
+	sku, err := value.NewSkuWithFormat("WXYZ-0034-00", f)
+	assert.Nil(t, err)
+	assert.Equal(t, "WXYZ-34-0", sku.StringWithoutZeros())
+}
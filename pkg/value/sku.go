@@ -1,9 +1,6 @@
 package value
 
 import (
-	"github.com/bernardosecades/feeder/pkg/tools/numberfn"
-	"github.com/bernardosecades/feeder/pkg/tools/stringfn"
-
 	"errors"
 	"strings"
 )
@@ -17,15 +14,51 @@ var (
 	ErrLenSecondPartSku    = errors.New("second part of sku should have length 4")
 	ErrLettersFirstPartSku = errors.New("first part only can content letters")
 	ErrNumberSecondPartSku = errors.New("second part only can content unsigned integer")
+	ErrLineTooLong         = errors.New("line is longer than the max length allowed")
 )
 
+// codes short identifier of each error to report them to clients
+var codes = map[error]string{
+	ErrSeparatorSku:        "SEPARATOR",
+	ErrLenFirstPartSku:     "LEN_FIRST_PART",
+	ErrLenSecondPartSku:    "LEN_SECOND_PART",
+	ErrLettersFirstPartSku: "LETTERS_FIRST_PART",
+	ErrNumberSecondPartSku: "NUMBER_SECOND_PART",
+	ErrLenPartSku:          "LEN_PART",
+	ErrLettersPartSku:      "LETTERS_PART",
+	ErrDigitsPartSku:       "DIGITS_PART",
+	ErrAlnumPartSku:        "ALNUM_PART",
+	ErrLineTooLong:         "LINE_TOO_LONG",
+}
+
+// ErrorCode return short identifier of an error reported by the package (UNKNOWN for other errors)
+func ErrorCode(err error) string {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if code, ok := codes[err]; ok {
+			return code
+		}
+	}
+
+	return "UNKNOWN"
+}
+
 type Sku struct {
-	value string
+	value  string
+	format *Format
 }
 
-// NewSku create new instance of Sku
+// NewSku create new instance of Sku with the default format (e.g.: KASL-3423)
 func NewSku(v string) (Sku, error) {
-	sku := Sku{value: v}
+	return NewSkuWithFormat(v, DefaultFormat)
+}
+
+// NewSkuWithFormat create new instance of Sku validated with a format compiled by ParseFormat
+func NewSkuWithFormat(v string, format *Format) (Sku, error) {
+	if format == nil {
+		format = DefaultFormat
+	}
+
+	sku := Sku{value: v, format: format}
 	err := sku.validateAndNormalize()
 	if err != nil {
 		return Sku{}, err
@@ -39,16 +72,30 @@ func (s Sku) String() string {
 	return s.value
 }
 
-// StringWithoutZeros return value without zeros from Sku
+// StringWithoutZeros return value without zeros on the left of digit parts from Sku
 func (s Sku) StringWithoutZeros() string {
-	parts := strings.Split(s.value, "-")
+	f := s.format
+	if f == nil {
+		f = DefaultFormat
+	}
+
+	parts, err := f.split(s.value)
+	if err != nil {
+		return s.value
+	}
 
-	secondPart := strings.TrimLeft(parts[1], "0")
-	if len(secondPart) == 0 {
-		secondPart = "0"
+	for i, p := range f.parts {
+		if p.class != digits {
+			continue
+		}
+
+		parts[i] = strings.TrimLeft(parts[i], "0")
+		if len(parts[i]) == 0 {
+			parts[i] = "0"
+		}
 	}
 
-	return parts[0] + separator + secondPart
+	return f.join(parts)
 }
 
 // validateAndNormalize it will clean (special characters), validate and normalize sku value
@@ -58,29 +105,12 @@ func (s *Sku) validateAndNormalize() error {
 	s.value = strings.ReplaceAll(s.value, "\r", "")
 	s.value = strings.Trim(s.value, " ")
 
-	parts := strings.Split(s.value, separator)
-	if len(parts) != 2 {
-		return ErrSeparatorSku
-	}
-
-	if len(parts[0]) != 4 {
-		return ErrLenFirstPartSku
-	}
-
-	if len(parts[1]) != 4 {
-		return ErrLenSecondPartSku
-	}
-
-	if !stringfn.IsOnlyLetters(parts[0]) {
-		return ErrLettersFirstPartSku
-	}
-
-	if !numberfn.IsUnsignedInteger(parts[1]) {
-		return ErrNumberSecondPartSku
+	// validate and normalize
+	v, err := s.format.validateAndNormalize(s.value)
+	if err != nil {
+		return err
 	}
-
-	// normalize
-	s.value = strings.ToUpper(parts[0]) + separator + parts[1]
+	s.value = v
 
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"errors"
 	"testing"
 )
 
@@ -19,6 +20,7 @@ func TestValidSku(t *testing.T) {
 		{" KASL-3423 \n",  "KASL-3423"},
 		{"\n KASL-3423 \n\r",  "KASL-3423"},
 		{"kasl-3423",  "KASL-3423"},
+		{"KASL-+123",  "KASL-+123"},
 	}
 
 	for _, c := range cases {
@@ -45,6 +47,18 @@ func TestInvalidSku(t *testing.T) {
 	assert.Equal(t, err, value.ErrLenSecondPartSku)
 }
 
+func TestErrorCode(t *testing.T) {
+	_, err := value.NewSku("AAAA*1234")
+	assert.Equal(t, "SEPARATOR", value.ErrorCode(err))
+
+	_, err = value.NewSku("AAA-12345")
+	assert.Equal(t, "LEN_FIRST_PART", value.ErrorCode(err))
+
+	assert.Equal(t, "LINE_TOO_LONG", value.ErrorCode(value.ErrLineTooLong))
+
+	assert.Equal(t, "UNKNOWN", value.ErrorCode(errors.New("other error")))
+}
+
 func TestSkuWithoutZeros(t *testing.T) {
 	cases := []struct {
 		skuInput    string